@@ -0,0 +1,51 @@
+package main
+
+// ACL controls who can change a POI or an AirBeacon
+// Owners can update, remove and change the ACL, editors and members of groups can only update
+type ACL struct {
+	Owners  []string `json:"owners,omitempty"`
+	Editors []string `json:"editors,omitempty"`
+	Groups  []string `json:"groups,omitempty"` // groups come from the JWT token's groups claim
+}
+
+// newACL returns the default ACL of an object: it's owned by its creator
+// objects without creator can only be changed by admin tokens
+func newACL(creator *string) *ACL {
+	if creator == nil {
+		return &ACL{}
+	}
+	return &ACL{Owners: []string{*creator}}
+}
+
+func contains(list []string, value string) bool {
+	for _, each := range list {
+		if each == value {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOwner returns true if the token can remove the object or change its ACL
+func (acl *ACL) allowsOwner(token *JWTToken) bool {
+	if token.Capabilities.Admin {
+		return true
+	}
+	return token.AgentID != "" && contains(acl.Owners, token.AgentID)
+}
+
+// allowsEdit returns true if the token can update the object
+func (acl *ACL) allowsEdit(token *JWTToken) bool {
+	if acl.allowsOwner(token) {
+		return true
+	}
+	if token.AgentID != "" && contains(acl.Editors, token.AgentID) {
+		return true
+	}
+	for _, group := range token.Groups {
+		if contains(acl.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
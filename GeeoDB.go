@@ -1,9 +1,9 @@
 package main
 
 import (
-	"errors"
 	"expvar"
 	"net/http"
+	"time"
 
 	"sync"
 
@@ -13,15 +13,30 @@ import (
 
 var (
 	// ErrNotImplemented is returned for actions without an implementation
-	ErrNotImplemented = errors.New("Not Implemented")
+	ErrNotImplemented = newError(CodeNotImplemented, http.StatusNotImplemented, "Not Implemented")
 	// ErrAgentNotFound is returned when agent can't be found
-	ErrAgentNotFound = errors.New("Agent doesn't exist")
+	ErrAgentNotFound = newError(CodeNotFound, http.StatusNotFound, "Agent doesn't exist")
+	// ErrAgentTooFar is returned when an agent is out of reach
+	ErrAgentTooFar = newError(CodeAgentTooFar, http.StatusBadRequest, "Agent is too far")
+	// ErrPOINotFound is returned when POI can't be found
+	ErrPOINotFound = newError(CodeNotFound, http.StatusNotFound, "POI doesn't exist")
+	// ErrRevocationNotFound is returned if a token or agent isn't revoked
+	ErrRevocationNotFound = newError(CodeNotFound, http.StatusNotFound, "Revocation not found")
+	// ErrAirBeaconNotFound is returned when AirBeacon can't be found
+	ErrAirBeaconNotFound = newError(CodeNotFound, http.StatusNotFound, "AirBeacon doesn't exist")
+	// ErrForbidden is returned when the ACL of an object doesn't allow a change
+	ErrForbidden = newError(CodeForbidden, http.StatusForbidden, "The ACL doesn't allow this change")
 	// ErrViewNotFound is returned when View can't be found
-	ErrViewNotFound = errors.New("View doesn't exist")
+	ErrViewNotFound = newError(CodeNotFound, http.StatusNotFound, "View doesn't exist")
 	// ErrAgentExistsAlready is returned when agent exists already
 	//ErrAgentExistsAlready = errors.New("Agent already exists")
-	// ErrPoiExistsAlready is returned when POI exists already
-	//ErrPoiExistsAlready = errors.New("POI already exists")
+	// ErrPOIExists is returned when POI exists already
+	ErrPOIExists = newError(CodePOIExists, http.StatusConflict, "POI already exists")
+	// ErrAirBeaconExists is returned when AirBeacon exists already
+	ErrAirBeaconExists = newError(CodeAirBeaconExists, http.StatusConflict, "AirBeacon already exists")
+
+	// POIReapInterval determines how often expired POIs are removed
+	POIReapInterval = 1000 * time.Millisecond
 
 	numPOIs, numABs, numViews, numAgents *expvar.Int
 )
@@ -34,6 +49,9 @@ type Persister interface {
 	removePOI(poi *POI) error
 	persistAirBeacon(ab *AirBeacon) error
 	removeAirBeacon(ab *AirBeacon) error
+	readRevocationsInto(revocations *revocationList) error
+	persistRevocation(r *Revocation) error
+	removeRevocation(r *Revocation) error
 	close()
 	BackupHandleFunc(w http.ResponseWriter, req *http.Request)
 	JSONDumpHandleFunc(w http.ResponseWriter, req *http.Request)
@@ -52,6 +70,7 @@ type GeeoDB struct {
 	ab        map[string]*AirBeacon
 	pois      map[string]*POI
 	persister Persister
+	expiries  poiExpiryQueue
 
 	tree quad.Quad
 	sync.RWMutex
@@ -88,20 +107,32 @@ func NewGeeoDB(pers Persister, depth int) *GeeoDB {
 	return newdb
 }
 
-func (db *GeeoDB) addAgent(id string, conn *wsConn, pub map[string]interface{}) *Agent {
+// addAgent adds an agent without position, or returns ErrAgentExists if the id is used
+func (db *GeeoDB) addAgent(id string, conn *wsConn, pub map[string]interface{}) (*Agent, error) {
 	newagent := &Agent{ID: &id, ws: conn, publicData: pub}
 
 	db.Lock()
 	defer db.Unlock()
 	if _, exists := db.agents[id]; exists {
-		log.Error("[BUG] should not attempt to add existing agent ", id)
+		return nil, ErrAgentExists
 	}
 
 	db.agents[id] = newagent
 
 	numAgents.Add(1)
 
-	return newagent
+	return newagent, nil
+}
+
+func (db *GeeoDB) getAgent(id string) (*Agent, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	agent, ok := db.agents[id]
+	if !ok {
+		return nil, ErrAgentNotFound
+	}
+	return agent, nil
 }
 
 func (db *GeeoDB) removeAgent(id string) {
@@ -155,41 +186,67 @@ func (db *GeeoDB) getPointLikeIn(pos *quad.Rect) set.Set {
 	return resultset
 }
 
-func (db *GeeoDB) addView(id string, conn *wsConn) *View {
-	v := &View{id: &id, ws: conn}
+func (db *GeeoDB) getPointLikeWithinRadius(center *quad.Point, meters float64) set.Set {
+	db.RLock()
+	defer db.RUnlock()
+
+	res := db.tree.GetPointsWithinRadius(center, meters)
+
+	resultset := set.NewThreadUnsafeSet() // no need for thread safety
+	for _, each := range res {
+		resultset.Add(each)
+	}
+	return resultset
+}
+
+// getNearestPointLike returns the k accepted points closest to center, closest first
+func (db *GeeoDB) getNearestPointLike(center *quad.Point, k int, maxMeters float64, acceptor quad.PointAcceptor) []quad.PointLike {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.tree.GetNearestPoints(center, k, maxMeters, acceptor)
+}
+
+// addView adds a view without position, or returns ErrViewExists if the id is used
+func (db *GeeoDB) addView(id string, name string, conn *wsConn) (*View, error) {
+	v := &View{id: &id, name: name, ws: conn}
 
 	db.Lock()
 	defer db.Unlock()
 
+	if _, exists := db.v[id]; exists {
+		return nil, ErrViewExists
+	}
 	numViews.Add(1)
 
 	db.v[id] = v
-	return v
+	return v, nil
+}
+
+// hasView returns true if v is the view with its id, db must be locked
+func (db *GeeoDB) hasView(v *View) bool {
+	return db.v[*v.id] == v
 }
 
-func (db *GeeoDB) removeView(id string) {
+func (db *GeeoDB) removeView(v *View) {
 	db.Lock()
 	defer db.Unlock()
 
-	v, ok := db.v[id]
-
-	if ok {
-		if v.GetRect() == nil {
-			return
+	if db.hasView(v) {
+		if v.GetRect() != nil {
+			db.tree.RemoveRect(v)
 		}
-		db.tree.RemoveRect(v)
-		delete(db.v, id)
+		delete(db.v, *v.id)
 		numViews.Add(-1)
 	}
 }
 
-func (db *GeeoDB) updateViewPosition(id string, pos *quad.Rect) *quad.Rect {
+func (db *GeeoDB) updateViewPosition(v *View, pos *quad.Rect) *quad.Rect {
 	db.Lock()
 	defer db.Unlock()
-	v, ok := db.v[id]
 
 	var oldPosition *quad.Rect
-	if ok {
+	if db.hasView(v) {
 		oldPosition = v.GetRect()
 		if oldPosition == nil {
 			v.SetRect(pos)
@@ -201,12 +258,25 @@ func (db *GeeoDB) updateViewPosition(id string, pos *quad.Rect) *quad.Rect {
 	return oldPosition
 }
 
-func (db *GeeoDB) addAirBeacon(id string, pos *quad.Rect, publicData map[string]interface{}, creator *string) *AirBeacon {
+// updateViewFilter replaces the filter of a view, and returns the previous one
+func (db *GeeoDB) updateViewFilter(v *View, filter *ViewFilter) *ViewFilter {
+	db.Lock()
+	defer db.Unlock()
+
+	if !db.hasView(v) {
+		return nil
+	}
+	previous := v.filter
+	v.filter = filter
+	return previous
+}
+
+func (db *GeeoDB) addAirBeacon(id string, pos *quad.Rect, shape quad.Shape, publicData map[string]interface{}, creator *string, acl *ACL) *AirBeacon {
 
 	db.Lock()
 	defer db.Unlock()
 
-	ab := &AirBeacon{id: &id, rect: pos, publicData: publicData, creator: creator}
+	ab := &AirBeacon{id: &id, rect: pos, shape: shape, publicData: publicData, creator: creator, acl: acl}
 	db.ab[id] = ab
 	db.tree.AddRect(ab)
 	db.persister.persistAirBeacon(ab)
@@ -216,12 +286,25 @@ func (db *GeeoDB) addAirBeacon(id string, pos *quad.Rect, publicData map[string]
 	return ab
 }
 
+func (db *GeeoDB) getViewsIntersecting(rect *quad.Rect) set.Set {
+	db.RLock()
+	defer db.RUnlock()
+
+	res := db.tree.GetRectsIntersecting(rect, func(each quad.RectLike) bool {
+		_, ok := each.(*View)
+		return ok
+	})
+	return res
+}
+
 // _loadPOI is really used to batch load POIs into the db without blocking or checks
-func (db *GeeoDB) _loadAirBeacon(id string, pos *quad.Rect, publicData map[string]interface{}, creator *string) *AirBeacon {
+func (db *GeeoDB) _loadAirBeacon(id string, pos *quad.Rect, shape quad.Shape, publicData map[string]interface{}, creator *string, acl *ACL) *AirBeacon {
 	airBeacon := &AirBeacon{
 		id:         &id,
+		shape:      shape,
 		publicData: publicData,
 		creator:    creator,
+		acl:        acl,
 	}
 	airBeacon.SetRect(pos)
 
@@ -241,6 +324,7 @@ func (db *GeeoDB) removeAirBeacon(id string) {
 	ab, ok := db.ab[id]
 
 	if ok {
+		delete(db.ab, id)
 		db.tree.RemoveRect(ab)
 		db.persister.removeAirBeacon(ab)
 		numABs.Add(-1)
@@ -255,7 +339,13 @@ func (db *GeeoDB) getRectLikeWithPoint(pos *quad.Point) set.Set {
 	db.RLock()
 	defer db.RUnlock()
 
-	res := db.tree.GetRectsWithPoint(pos, quad.AcceptAll)
+	// AirBeacons are stored by their bounding box, we have to check their exact area
+	res := db.tree.GetRectsWithPoint(pos, func(each quad.RectLike) bool {
+		if ab, ok := each.(*AirBeacon); ok {
+			return ab.containsPoint(pos)
+		}
+		return true
+	})
 	return res
 }
 func (db *GeeoDB) getViewsWithPoint(pos *quad.Point) set.Set {
@@ -274,11 +364,13 @@ func (db *GeeoDB) getViewsWithPoint(pos *quad.Point) set.Set {
 }
 
 // _loadPOI is really used to batch load POIs into the db without blocking or checks
-func (db *GeeoDB) _loadPOI(id string, pos *quad.Point, publicData map[string]interface{}, creator *string) *POI {
+func (db *GeeoDB) _loadPOI(id string, pos *quad.Point, publicData map[string]interface{}, creator *string, acl *ACL, expiresAt *time.Time) *POI {
 	poi := &POI{
 		id:         &id,
 		publicData: publicData,
 		creator:    creator,
+		acl:        acl,
+		expiresAt:  expiresAt,
 	}
 	poi.SetPoint(pos)
 
@@ -287,15 +379,17 @@ func (db *GeeoDB) _loadPOI(id string, pos *quad.Point, publicData map[string]int
 
 	db.pois[id] = poi
 	db.tree.AddPoint(poi)
+	db.scheduleExpiry(poi)
 	return poi
 }
 
-func (db *GeeoDB) addPOI(id string, pos *quad.Point, publicData map[string]interface{}, creator *string) *POI {
+// addPOI adds a POI, expiresAt can be nil for POIs which never expire
+func (db *GeeoDB) addPOI(id string, pos *quad.Point, publicData map[string]interface{}, creator *string, acl *ACL, expiresAt *time.Time) *POI {
 	if _, exists := db.pois[id]; exists {
 		log.Error("[BUG] should not attempt to add existing poi ", id)
 	}
 
-	poi := db._loadPOI(id, pos, publicData, creator)
+	poi := db._loadPOI(id, pos, publicData, creator, acl, expiresAt)
 	db.persister.persistPOI(poi)
 
 	numPOIs.Add(1)
@@ -303,6 +397,42 @@ func (db *GeeoDB) addPOI(id string, pos *quad.Point, publicData map[string]inter
 	return poi
 }
 
+func (db *GeeoDB) getPOI(id string) (*POI, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	poi, ok := db.pois[id]
+	if !ok {
+		return nil, ErrPOINotFound
+	}
+	return poi, nil
+}
+
+// updatePOI moves the POI if pos isn't nil, and replaces its publicData, ACL and expiry if they aren't nil
+// it returns the position of the POI before the move
+func (db *GeeoDB) updatePOI(poi *POI, pos *quad.Point, publicData map[string]interface{}, acl *ACL, expiresAt *time.Time) *quad.Point {
+	db.Lock()
+	defer db.Unlock()
+
+	oldPosition := poi.GetPoint()
+	if pos != nil {
+		db.tree.MovePoint(poi, pos)
+	}
+	if publicData != nil {
+		poi.publicData = publicData
+	}
+	if acl != nil {
+		poi.acl = acl
+	}
+	if expiresAt != nil {
+		poi.expiresAt = expiresAt
+		db.scheduleExpiry(poi)
+	}
+	db.persister.persistPOI(poi)
+
+	return oldPosition
+}
+
 func (db *GeeoDB) removePOI(poi *POI) {
 	db.Lock()
 	defer db.Unlock()
@@ -310,12 +440,17 @@ func (db *GeeoDB) removePOI(poi *POI) {
 	_, ok := db.pois[*poi.id]
 
 	if ok {
-		delete(db.pois, *poi.id)
-		db.tree.RemovePoint(poi)
-		db.persister.removePOI(poi)
-
-		numPOIs.Add(-1)
+		db._removePOI(poi)
 	} else {
 		log.Warn("should not attempt to remove missing poi ", poi.id)
 	}
 }
+
+// _removePOI must be called with the db lock held
+func (db *GeeoDB) _removePOI(poi *POI) {
+	delete(db.pois, *poi.id)
+	db.tree.RemovePoint(poi)
+	db.persister.removePOI(poi)
+
+	numPOIs.Add(-1)
+}
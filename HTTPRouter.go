@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+
+	"geeo.io/GeeoServer/quad"
 
 	"github.com/sirupsen/logrus"
 
@@ -16,15 +20,14 @@ func withTokenAndDB(db *GeeoDB, wsh *WSRouter, fn func(http.ResponseWriter, *htt
 		if t == "" {
 			t = req.URL.Query().Get("token")
 		}
+		w.Header().Set("Content-type", "application/json")
 		token, err := parseJWTToken(t)
-		if err != nil || !token.Capabilities.HTTP {
-			message := struct {
-				Error   string `json:"error"`
-				Message string `json:"message"`
-			}{"Can't parse token, or token invalid", err.Error()}
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(message)
-			log.Warn("HTTP route: can't parse token, or token without HTTP cap")
+		if err != nil {
+			writeHTTPError(w, req.URL.Path, tokenError(err))
+			return
+		}
+		if !token.Capabilities.HTTP {
+			writeHTTPError(w, req.URL.Path, ErrCantUseHTTP)
 			return
 		}
 		fn(w, req, token, db, wsh)
@@ -47,8 +50,14 @@ func NewHTTPRouter(router *mux.Router, db *GeeoDB, wsh *WSRouter) *mux.Router {
 
 	router.HandleFunc("/v1/airbeacon", withTokenAndDB(db, wsh, addRemoveAirBeacon))
 
+	router.HandleFunc("/v1/event", withTokenAndDB(db, wsh, sendEvent))
+
+	router.HandleFunc("/v1/radius", withTokenAndDB(db, wsh, getPointsWithinRadius))
+
 	router.HandleFunc("/v1/log", setLogLevel) // doesn't need additional security, awaits bearer token
 
+	router.HandleFunc("/v1/revocations", revocationsHandleFunc(db.persister, wsh)) // awaits bearer token
+
 	return router
 }
 
@@ -56,66 +65,80 @@ func addRemovePOI(w http.ResponseWriter, req *http.Request, token *JWTToken, db
 	w.Header().Set("Content-type", "application/json")
 
 	if !token.Capabilities.POI {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"Your token doesn't allow POI creation/removal"})
-		log.Warn("POI HTTP route: Your token doesn't allow POI creation/removal")
-
+		writeHTTPError(w, "POI", ErrCantUpdatePOI.withDetail("Your token doesn't allow POI creation/removal"))
 		return
 	}
 
-	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"Only POST and DELETE are supported by this endpoint"})
-		log.Warn("POI HTTP route: Only POST and DELETE are supported by this endpoint")
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete && req.Method != http.MethodPatch {
+		writeHTTPError(w, "POI", ErrMethodNotAllowed.withDetail("Only POST, PATCH and DELETE are supported by this endpoint"))
 		return
 	}
 
 	cmd := &JSONPOI{}
 	err := json.NewDecoder(req.Body).Decode(cmd)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"Can't parse json body"})
-		log.Warn("POI HTTP route: Can't parse json body")
+		writeHTTPError(w, "POI", ErrInvalidMessage.withDetail("Can't parse json body"))
 		return
 	}
 	log.Debug("POI HTTP command: ", cmd)
 
 	switch req.Method {
 	case http.MethodPost:
+		if err := cmd.check(); err != nil {
+			writeHTTPError(w, "POI", invalidCommand(err))
+			return
+		}
+		if err := token.Capabilities.checkPoint(cmd.Pos); err != nil {
+			writeHTTPError(w, "POI", err)
+			return
+		}
+		if _, err := db.getPOI(*cmd.ID); err == nil {
+			writeHTTPError(w, "POI", ErrPOIExists)
+			return
+		}
 		log.Info("POST /v1/POI: ", *cmd.ID, " created by ", cmd.Creator, " at ", cmd.Pos)
-		poi := db.addPOI(*cmd.ID, cmd.Pos, cmd.PublicData, cmd.Creator)
+		poi := db.addPOI(*cmd.ID, cmd.Pos, cmd.PublicData, cmd.Creator, cmd.acl(cmd.Creator), cmd.expiry())
 
 		go func() {
 			message := poi.enterLeaveMessage(true)
-			wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint())
+			wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint(), poi)
 		}()
 
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(*poi)
+	case http.MethodPatch:
+		if err := cmd.checkUpdate(); err != nil {
+			writeHTTPError(w, "POI", invalidCommand(err))
+			return
+		}
+		log.Info("PATCH /v1/POI: ", *cmd.ID)
+		poi, err := wsh.handlePOIUpdate(cmd.ID, cmd.Pos, cmd.PublicData, cmd.ACL, cmd.expiry(), token)
+		if err != nil {
+			writeHTTPError(w, "POI", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(pointLikeToJSON(poi))
 	case http.MethodDelete:
+		if cmd.ID == nil {
+			writeHTTPError(w, "POI", invalidCommand(errors.New("Invalid POI ID")))
+			return
+		}
 		log.Info("DELETE /v1/POI: ", *cmd.ID)
-		db.RLock()
-		poi, found := db.pois[*cmd.ID]
-		db.RUnlock()
-		if !found {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(struct {
-				Error string
-			}{"POI not found"})
-			log.Warn("POI HTTP route: POI not found")
+		poi, err := db.getPOI(*cmd.ID)
+		if err != nil {
+			writeHTTPError(w, "POI", err)
+			return
+		}
+		if !poi.acl.allowsOwner(token) {
+			writeHTTPError(w, "POI", ErrForbidden)
 			return
 		}
 		db.removePOI(poi)
 
 		go func() {
 			message := poi.enterLeaveMessage(false)
-			wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint())
+			wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint(), poi)
 		}()
 
 		w.WriteHeader(http.StatusOK)
@@ -127,52 +150,63 @@ func addRemoveAirBeacon(w http.ResponseWriter, req *http.Request, token *JWTToke
 	w.Header().Set("Content-type", "application/json")
 
 	if !token.Capabilities.AirBeacon {
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"Your token doesn't allow Air Beacon creation/removal"})
-		log.Warn("AirBeacon HTTP route: Your token doesn't allow Air Beacon creation/removal")
-
+		writeHTTPError(w, "AirBeacon", ErrCantUpdateAirBeacon.withDetail("Your token doesn't allow Air Beacon creation/removal"))
 		return
 	}
 
 	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"Only POST and DELETE are supported by this endpoint"})
-		log.Warn("AirBeacon HTTP route: Only POST and DELETE are supported by this endpoint")
+		writeHTTPError(w, "AirBeacon", ErrMethodNotAllowed.withDetail("Only POST and DELETE are supported by this endpoint"))
 		return
 	}
 
 	cmd := &JSONAirBeacon{}
 	err := json.NewDecoder(req.Body).Decode(cmd)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"Can't parse json body"})
-		log.Warn("AirBeacon HTTP route: Can't parse json body")
+		writeHTTPError(w, "AirBeacon", ErrInvalidMessage.withDetail("Can't parse json body"))
 		return
 	}
 	log.Debug("Airbeacon HTTP command: ", cmd)
 
 	switch req.Method {
 	case http.MethodPost:
+		if err := cmd.check(); err != nil {
+			writeHTTPError(w, "AirBeacon", invalidCommand(err))
+			return
+		}
+		if err := token.Capabilities.checkAirBeaconSize(cmd); err != nil {
+			writeHTTPError(w, "AirBeacon", err)
+			return
+		}
+		if err := token.Capabilities.checkRect(cmd.Pos); err != nil {
+			writeHTTPError(w, "AirBeacon", err)
+			return
+		}
+		db.RLock()
+		_, exists := db.ab[*cmd.ID]
+		db.RUnlock()
+		if exists {
+			writeHTTPError(w, "AirBeacon", ErrAirBeaconExists)
+			return
+		}
 		log.Info("POST /v1/airbeacon: ", *cmd.ID, " created by ", cmd.Creator, " at ", cmd.Pos)
-		poi := db.addAirBeacon(*cmd.ID, cmd.Pos, cmd.PublicData, cmd.Creator)
+		poi := db.addAirBeacon(*cmd.ID, cmd.Pos, cmd.shape(), cmd.PublicData, cmd.Creator, cmd.acl(cmd.Creator))
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(*poi)
 	case http.MethodDelete:
+		if cmd.ID == nil {
+			writeHTTPError(w, "AirBeacon", invalidCommand(errors.New("Invalid AirBeacon ID")))
+			return
+		}
 		log.Info("DELETE /v1/airbeacon: ", *cmd.ID)
 		db.RLock()
 		ab, found := db.ab[*cmd.ID]
 		db.RUnlock()
 		if !found {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(struct {
-				Error string
-			}{"AirBeacon not found"})
-			log.Warn("AirBeacon HTTP route: AirBeacon not found")
+			writeHTTPError(w, "AirBeacon", ErrAirBeaconNotFound)
+			return
+		}
+		if !ab.acl.allowsOwner(token) {
+			writeHTTPError(w, "AirBeacon", ErrForbidden)
 			return
 		}
 		db.removeAirBeacon(*ab.id)
@@ -181,6 +215,93 @@ func addRemoveAirBeacon(w http.ResponseWriter, req *http.Request, token *JWTToke
 	}
 }
 
+func sendEvent(w http.ResponseWriter, req *http.Request, token *JWTToken, db *GeeoDB, wsh *WSRouter) {
+	w.Header().Set("Content-type", "application/json")
+
+	if !token.Capabilities.SendEvents {
+		writeHTTPError(w, "Event", ErrCantSendEvents.withDetail("Your token doesn't allow sending events"))
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeHTTPError(w, "Event", ErrMethodNotAllowed.withDetail("Only POST is supported by this endpoint"))
+		return
+	}
+
+	event := &JSONEvent{}
+	err := json.NewDecoder(req.Body).Decode(event)
+	if err != nil {
+		writeHTTPError(w, "Event", ErrInvalidMessage.withDetail("Can't parse json body"))
+		return
+	}
+	if err := event.check(); err != nil {
+		writeHTTPError(w, "Event", invalidCommand(err))
+		return
+	}
+	// like radius searches, the circle must fit in the largest view allowed by the token
+	if err := token.Capabilities.checkRadius(event.Radius); err != nil {
+		writeHTTPError(w, "Event", err)
+		return
+	}
+	if err := token.Capabilities.checkCircle(event.Pos, event.Radius); err != nil {
+		writeHTTPError(w, "Event", err)
+		return
+	}
+	log.Debug("POST /v1/event at ", event.Pos, " radius ", event.Radius)
+
+	// events sent by the HTTP API come from no agent, the body can't pretend otherwise
+	event.From = nil
+	go wsh.handleEvent(event)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(event)
+}
+
+func getPointsWithinRadius(w http.ResponseWriter, req *http.Request, token *JWTToken, db *GeeoDB, wsh *WSRouter) {
+	w.Header().Set("Content-type", "application/json")
+
+	if !token.Capabilities.Consume {
+		writeHTTPError(w, "Radius", ErrCantConsume.withDetail("Your token doesn't allow consuming"))
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		writeHTTPError(w, "Radius", ErrMethodNotAllowed.withDetail("Only GET is supported by this endpoint"))
+		return
+	}
+
+	query := req.URL.Query()
+	lon, errLon := strconv.ParseFloat(query.Get("lon"), 64)
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	radius, errRadius := strconv.ParseFloat(query.Get("radius"), 64)
+	center := quad.Point{lon, lat}
+	if errLon != nil || errLat != nil || errRadius != nil || radius < 0 || !center.IsValid() {
+		writeHTTPError(w, "Radius", ErrInvalidCommand.withDetail("lon, lat and radius (in meters) are required"))
+		return
+	}
+
+	// the circle must fit in the largest view allowed by the token
+	if err := token.Capabilities.checkRadius(radius); err != nil {
+		writeHTTPError(w, "Radius", err)
+		return
+	}
+	if err := token.Capabilities.checkCircle(&center, radius); err != nil {
+		writeHTTPError(w, "Radius", err)
+		return
+	}
+
+	res := []interface{}{}
+	for each := range db.getPointLikeWithinRadius(&center, radius).Iter() {
+		if each == nil {
+			continue
+		}
+		res = append(res, pointLikeToJSON(each))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
 func setLogLevel(w http.ResponseWriter, req *http.Request) {
 	auth := req.Header.Get("Authorization")
 
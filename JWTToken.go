@@ -1,48 +1,185 @@
 package main
 
 import (
-	"errors"
 	"fmt"
+	"net/http"
+
+	"geeo.io/GeeoServer/quad"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
 var (
 	// ErrCantProduce is returned when attempting to produce on a socket that doesn't have that capability
-	ErrCantProduce = errors.New("can't produce")
+	ErrCantProduce = newError(CodeNotAllowed, http.StatusForbidden, "can't produce")
 
 	// ErrCantConsume is returned when attempting to produce on a socket that doesn't have that capability
-	ErrCantConsume = errors.New("can't consume")
+	ErrCantConsume = newError(CodeNotAllowed, http.StatusForbidden, "can't consume")
 
 	// ErrCantUpdatePOI is returned when attempting to produce on a socket that doesn't have that capability
-	ErrCantUpdatePOI = errors.New("can't update POI")
+	ErrCantUpdatePOI = newError(CodeNotAllowed, http.StatusForbidden, "can't update POI")
 
 	// ErrCantUpdateAirBeacon is returned when attempting to produce on a socket that doesn't have that capability
-	ErrCantUpdateAirBeacon = errors.New("can't update AirBeacon")
+	ErrCantUpdateAirBeacon = newError(CodeNotAllowed, http.StatusForbidden, "can't update AirBeacon")
+
+	// ErrCantSendEvents is returned when attempting to send events on a socket that doesn't have that capability
+	ErrCantSendEvents = newError(CodeNotAllowed, http.StatusForbidden, "can't send events")
+
+	// ErrCantSendMessages is returned when attempting to send messages on a socket that doesn't have that capability
+	ErrCantSendMessages = newError(CodeNotAllowed, http.StatusForbidden, "can't send messages")
+
+	// ErrCantUseHTTP is returned when using the HTTP API without the capability
+	ErrCantUseHTTP = newError(CodeNotAllowed, http.StatusForbidden, "can't use the HTTP API")
 
 	// ErrInvalidCapabilities is returned if the set of capabilities is not coherent
-	ErrInvalidCapabilities = errors.New("invalid capabilities")
+	ErrInvalidCapabilities = newError(CodeInvalidCapabilities, http.StatusUnauthorized, "invalid capabilities")
 
 	// ErrInvalidJWTToken is returned if the token isn't valid
-	ErrInvalidJWTToken = errors.New("invalid JWT token")
+	ErrInvalidJWTToken = newError(CodeTokenInvalid, http.StatusUnauthorized, "invalid JWT token")
+
+	// ErrTokenRevoked is returned if the token, or its agent, was revoked, and sent before disconnecting websockets when it's revoked
+	ErrTokenRevoked = newError(CodeTokenRevoked, http.StatusUnauthorized, "JWT token revoked")
+
+	// ErrTokenExpired is returned if the token expired, and sent before disconnecting websockets when it expires
+	ErrTokenExpired = newError(CodeTokenExpired, http.StatusUnauthorized, "JWT token expired")
 )
 
 // JWTTokenCaps allows specification of Capabilities for this socket
 type JWTTokenCaps struct {
-	Produce       bool       `json:"produce"`
-	Consume       bool       `json:"consume"`
-	POI           bool       `json:"createPOI"`
-	AirBeacon     bool       `json:"createAirBeacon"`
-	SendEvents    bool       `json:"sendEvents"`
-	ReceiveEvents bool       `json:"receiveEvents"`
-	MaxView       [2]float64 `json:"maxView"`
-	MaxAirBeacon  [2]float64 `json:"maxAirBeacon"`
-	HTTP          bool       `json:"http"`
+	Produce            bool       `json:"produce"`
+	Consume            bool       `json:"consume"`
+	POI                bool       `json:"createPOI"`
+	AirBeacon          bool       `json:"createAirBeacon"`
+	SendEvents         bool       `json:"sendEvents"`
+	ReceiveEvents      bool       `json:"receiveEvents"`
+	SendMessages       bool       `json:"sendMessages"`
+	MaxView            [2]float64 `json:"maxView"`
+	MaxViews           int        `json:"maxViews"`
+	MaxAirBeacon       [2]float64 `json:"maxAirBeacon"`
+	MaxAirBeaconRadius float64    `json:"maxAirBeaconRadius"` // in meters, 0 for no limit
+	HTTP               bool       `json:"http"`
+	Admin              bool       `json:"admin"` // bypass ACLs
+
+	Regions []quad.Rect `json:"regions"` // where agents, views, POIs and AirBeacons can be placed, anywhere if empty
+
+	RateLimits map[string]RateLimit `json:"rateLimits"` // by command, overriding DefaultRateLimits for these commands
+}
+
+// setDefaults fills the limits a token doesn't set
+func (cap *JWTTokenCaps) setDefaults() {
+	if cap.MaxView == [2]float64{} {
+		cap.MaxView = [2]float64{1, 1}
+	}
+	if cap.MaxViews == 0 {
+		cap.MaxViews = 1 // the token's view
+	}
+	if cap.MaxAirBeacon == [2]float64{} {
+		cap.MaxAirBeacon = [2]float64{1, 1}
+	}
 }
 
+// check returns ErrInvalidCapabilities if the capabilities aren't coherent, it must be called after setDefaults
 func (cap *JWTTokenCaps) check() error {
-	if !cap.Produce && !cap.Consume && !cap.POI && !cap.AirBeacon {
-		return ErrInvalidCapabilities
+	if !cap.Produce && !cap.Consume && !cap.POI && !cap.AirBeacon && !cap.SendEvents && !cap.ReceiveEvents && !cap.SendMessages && !cap.HTTP && !cap.Admin {
+		return ErrInvalidCapabilities.withDetail("the token doesn't allow anything")
+	}
+	if !validSize(cap.MaxView) {
+		return ErrInvalidCapabilities.withDetail("maxView must be within [360, 180]")
+	}
+	if !validSize(cap.MaxAirBeacon) {
+		return ErrInvalidCapabilities.withDetail("maxAirBeacon must be within [360, 180]")
+	}
+	if cap.MaxViews < 1 {
+		return ErrInvalidCapabilities.withDetail("maxViews must be at least 1")
+	}
+	if cap.MaxAirBeaconRadius < 0 {
+		return ErrInvalidCapabilities.withDetail("maxAirBeaconRadius can't be negative")
+	}
+	for _, region := range cap.Regions {
+		if !region.IsValid() {
+			return ErrInvalidCapabilities.withDetail("regions must be valid [lon1, lat1, lon2, lat2] rects")
+		}
+	}
+	for command, limit := range cap.RateLimits {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return ErrInvalidCapabilities.withDetail("the rate limit of " + command + " can't be negative")
+		}
+	}
+	return nil
+}
+
+func validSize(size [2]float64) bool {
+	return size[0] > 0 && size[0] <= 360 && size[1] > 0 && size[1] <= 180
+}
+
+// checkViewSize returns ErrViewTooLarge if a view at pos is larger than allowed
+func (cap *JWTTokenCaps) checkViewSize(pos *quad.Rect) error {
+	size := pos.Size()
+	if size[0] > cap.MaxView[0] || size[1] > cap.MaxView[1] {
+		return ErrViewTooLarge
+	}
+	return nil
+}
+
+// checkAirBeaconSize returns ErrAirBeaconTooLarge if an AirBeacon is larger than allowed
+// ab must have been checked, so that its Pos is set
+func (cap *JWTTokenCaps) checkAirBeaconSize(ab *JSONAirBeacon) error {
+	size := ab.Pos.Size()
+	if size[0] > cap.MaxAirBeacon[0] || size[1] > cap.MaxAirBeacon[1] {
+		return ErrAirBeaconTooLarge
+	}
+	if ab.Circle != nil && cap.MaxAirBeaconRadius > 0 && ab.Circle.Radius > cap.MaxAirBeaconRadius {
+		return ErrAirBeaconTooLarge
+	}
+	return nil
+}
+
+// checkPoint returns ErrOutsideRegion if pos isn't in one of the allowed regions
+func (cap *JWTTokenCaps) checkPoint(pos *quad.Point) error {
+	if len(cap.Regions) == 0 {
+		return nil
+	}
+	for i := range cap.Regions {
+		if cap.Regions[i].Contains(pos) {
+			return nil
+		}
+	}
+	return ErrOutsideRegion
+}
+
+// checkRect returns ErrOutsideRegion if pos doesn't fit in one of the allowed regions
+func (cap *JWTTokenCaps) checkRect(pos *quad.Rect) error {
+	if len(cap.Regions) == 0 {
+		return nil
+	}
+	for i := range cap.Regions {
+		if cap.Regions[i].ContainsRect(pos) {
+			return nil
+		}
+	}
+	return ErrOutsideRegion
+}
+
+// checkCircle returns ErrOutsideRegion if the circle of an event or a radius search doesn't fit in one of the allowed regions
+func (cap *JWTTokenCaps) checkCircle(center *quad.Point, radius float64) error {
+	area := quad.Circle{Center: *center, Radius: radius}.BoundingRect()
+	return cap.checkRect(&area)
+}
+
+// allowsPoint returns true if pos is in one of the allowed regions, or if there are none
+func (cap *JWTTokenCaps) allowsPoint(pos *quad.Point) bool {
+	return cap.checkPoint(pos) == nil
+}
+
+// maxRadius returns the largest radius in meters of a search: half of the height of the largest view allowed
+func (cap *JWTTokenCaps) maxRadius() float64 {
+	return quad.DegreesToMeters(cap.MaxView[1] / 2)
+}
+
+// checkRadius returns ErrRadiusTooLarge if a circle of radius meters doesn't fit in the largest view allowed
+func (cap *JWTTokenCaps) checkRadius(radius float64) error {
+	if 2*quad.MetersToDegrees(radius) > cap.MaxView[1] {
+		return ErrRadiusTooLarge
 	}
 	return nil
 }
@@ -51,8 +188,9 @@ func (cap *JWTTokenCaps) check() error {
 type JWTToken struct {
 	jwt.StandardClaims
 
-	AgentID string `json:"agentId"`
-	ViewID  string `json:"viewId"`
+	AgentID string   `json:"agentId"`
+	ViewID  string   `json:"viewId"`
+	Groups  []string `json:"groups"` // used by ACLs
 
 	Public       map[string]interface{} `json:"publicProperties"`
 	Capabilities JWTTokenCaps           `json:"caps"`
@@ -64,10 +202,18 @@ func parseJWTToken(b64tok string) (*JWTToken, error) {
 
 	token, err := jwt.ParseWithClaims(b64tok, &jwttoken, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if SecretKey == "" {
+				return nil, fmt.Errorf("%v tokens aren't accepted", token.Header["alg"])
+			}
+			return []byte(SecretKey), nil
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+			// public keys are selected by kid
+			kid, _ := token.Header["kid"].(string)
+			return publicKeys.get(kid, token.Method)
 		}
-		return []byte(SecretKey), nil
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 	})
 	if err != nil {
 		return nil, err
@@ -75,11 +221,26 @@ func parseJWTToken(b64tok string) (*JWTToken, error) {
 
 	if claims, ok := token.Claims.(*JWTToken); ok && token.Valid {
 		//log.Print(claims)
-		if claims.Capabilities.MaxView[0] == 0 {
-			claims.Capabilities.MaxView = [2]float64{1, 1} // default to [1,1]
+		if revocations.revokes(claims) != nil {
+			return nil, ErrTokenRevoked
+		}
+		claims.Capabilities.setDefaults()
+		if err := claims.Capabilities.check(); err != nil {
+			return nil, err
 		}
 		return claims, nil
 	}
 	return nil, ErrInvalidJWTToken
 
 }
+
+// tokenError returns the error sent when a token can't be used: INVALID_CAPABILITIES, TOKEN_EXPIRED, TOKEN_REVOKED, or TOKEN_INVALID with details
+func tokenError(err error) *GeeoError {
+	if gerr, ok := err.(*GeeoError); ok {
+		return gerr
+	}
+	if verr, ok := err.(*jwt.ValidationError); ok && verr.Errors&jwt.ValidationErrorExpired != 0 {
+		return ErrTokenExpired
+	}
+	return ErrInvalidJWTToken.withDetail(err.Error())
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"geeo.io/GeeoServer/quad"
+)
+
+func TestJWTTokenCapsCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		caps  JWTTokenCaps
+		valid bool
+	}{
+		{"nothing", JWTTokenCaps{}, false},
+		{"produce", JWTTokenCaps{Produce: true}, true},
+		{"receiveEvents", JWTTokenCaps{ReceiveEvents: true}, true},
+		{"sendMessages", JWTTokenCaps{SendMessages: true}, true},
+		{"admin", JWTTokenCaps{Admin: true}, true},
+		{"a large view", JWTTokenCaps{Consume: true, MaxView: [2]float64{361, 1}}, false},
+		{"no views", JWTTokenCaps{Consume: true, MaxViews: -1}, false},
+		{"a negative AirBeacon radius", JWTTokenCaps{AirBeacon: true, MaxAirBeaconRadius: -1}, false},
+		{"an invalid region", JWTTokenCaps{Produce: true, Regions: []quad.Rect{quad.NewRect(0, 10, 10, 0)}}, false},
+		{"a region", JWTTokenCaps{Produce: true, Regions: []quad.Rect{quad.NewRect(170, -10, -170, 10)}}, true},
+	}
+	for _, test := range tests {
+		test.caps.setDefaults()
+		if err := test.caps.check(); (err == nil) != test.valid {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
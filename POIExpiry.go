@@ -0,0 +1,65 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// poiExpiry is an entry of the expiry queue
+// entries aren't removed when POIs are removed or their expiry changes, they're skipped when they're stale
+type poiExpiry struct {
+	poi *POI
+	at  time.Time
+}
+
+// poiExpiryQueue is a min heap of expiries, the next POI to expire first
+type poiExpiryQueue []poiExpiry
+
+func (q poiExpiryQueue) Len() int            { return len(q) }
+func (q poiExpiryQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q poiExpiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *poiExpiryQueue) Push(x interface{}) { *q = append(*q, x.(poiExpiry)) }
+func (q *poiExpiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = poiExpiry{} // don't keep a reference to the POI
+	*q = old[:n-1]
+	return item
+}
+
+// scheduleExpiry must be called with the db lock held
+func (db *GeeoDB) scheduleExpiry(poi *POI) {
+	if poi.expiresAt != nil {
+		heap.Push(&db.expiries, poiExpiry{poi: poi, at: *poi.expiresAt})
+	}
+}
+
+// removeExpiredPOIs removes the POIs which expired before now, and returns them
+func (db *GeeoDB) removeExpiredPOIs(now time.Time) []*POI {
+	db.Lock()
+	defer db.Unlock()
+
+	var expired []*POI
+	for db.expiries.Len() > 0 && !db.expiries[0].at.After(now) {
+		next := heap.Pop(&db.expiries).(poiExpiry)
+		poi := next.poi
+		if db.pois[*poi.id] != poi || poi.expiresAt == nil || !poi.expiresAt.Equal(next.at) {
+			continue // stale entry
+		}
+		db._removePOI(poi)
+		expired = append(expired, poi)
+	}
+	return expired
+}
+
+// reapExpiredPOIs removes expired POIs every interval, and calls onExpired for each of them
+// it never returns
+func (db *GeeoDB) reapExpiredPOIs(interval time.Duration, onExpired func(poi *POI)) {
+	for now := range time.Tick(interval) {
+		for _, poi := range db.removeExpiredPOIs(now) {
+			log.Debug("POI expired: ", *poi.id)
+			onExpired(poi)
+		}
+	}
+}
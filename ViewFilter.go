@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+)
+
+// ViewFilter selects the Agents and POIs a View receives, all its conditions must match
+// objects which don't match never enter the view, and the view doesn't receive their messages
+type ViewFilter struct {
+	Type string                   `json:"type,omitempty"` // "agent" or "poi", both if empty
+	Eq   map[string]interface{}   `json:"eq,omitempty"`   // publicData fields equal to these values
+	In   map[string][]interface{} `json:"in,omitempty"`   // publicData fields equal to one of these values
+	Min  map[string]float64       `json:"min,omitempty"`  // numeric publicData fields at least equal to these values
+	Max  map[string]float64       `json:"max,omitempty"`  // numeric publicData fields at most equal to these values
+}
+
+func (f *ViewFilter) check() error {
+	if f.Type != "" && f.Type != "agent" && f.Type != "poi" {
+		return errors.New("Invalid filter type")
+	}
+	return nil
+}
+
+// filterable is implemented by the objects views can filter
+type filterable interface {
+	filterType() string
+	filterData() map[string]interface{}
+}
+
+func (a *Agent) filterType() string                 { return "agent" }
+func (a *Agent) filterData() map[string]interface{} { return a.publicData }
+func (poi *POI) filterType() string                 { return "poi" }
+func (poi *POI) filterData() map[string]interface{} { return poi.publicData }
+
+// filterSnapshot keeps the state of an object before a change, to know which views accepted it
+type filterSnapshot struct {
+	kind string
+	data map[string]interface{}
+}
+
+func (s filterSnapshot) filterType() string                 { return s.kind }
+func (s filterSnapshot) filterData() map[string]interface{} { return s.data }
+
+func snapshot(subject filterable) filterSnapshot {
+	return filterSnapshot{kind: subject.filterType(), data: subject.filterData()}
+}
+
+// accepts returns true if the filter matches the subject, a nil filter or subject matches everything
+func (f *ViewFilter) accepts(subject filterable) bool {
+	if f == nil || subject == nil {
+		return true
+	}
+	if f.Type != "" && f.Type != subject.filterType() {
+		return false
+	}
+	data := subject.filterData()
+	for field, expected := range f.Eq {
+		if !jsonEqual(data[field], expected) {
+			return false
+		}
+	}
+	for field, values := range f.In {
+		found := false
+		for _, expected := range values {
+			if jsonEqual(data[field], expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for field, min := range f.Min {
+		if value, ok := number(data[field]); !ok || value < min {
+			return false
+		}
+	}
+	for field, max := range f.Max {
+		if value, ok := number(data[field]); !ok || value > max {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonEqual compares decoded values, arrays and objects can't be compared with ==
+// numbers are equal whatever their type: msgpack decodes integers, JSON decodes float64
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	switch a.(type) {
+	case nil, bool, string:
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number converts the numeric types of JSON and msgpack decoders to float64
+func number(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"geeo.io/GeeoServer/quad"
 	set "github.com/deckarep/golang-set"
 )
@@ -11,7 +13,7 @@ func (wsh *WSRouter) handleAgentMove(agent *Agent, pos *quad.Point) {
 
 	enterMessage := agent.enterLeaveMessage(true)
 
-	agentMessageB := AgentMoveMessage{
+	agentMessageB := &AgentMoveMessage{
 		ID:    agent.ID,
 		Point: agent.Point,
 	}
@@ -24,18 +26,18 @@ func (wsh *WSRouter) handleAgentMove(agent *Agent, pos *quad.Point) {
 		afterViews := wsh.db.getRectLikeWithPoint(pos)
 
 		agentleftview := beforeViews.Difference(afterViews)
-		wsh.sendMessageToConsumers(leaveMessage, agentleftview)
+		wsh.sendMessageToConsumers(leaveMessage, agentleftview, agent)
 
 		agentmovedinview := beforeViews.Intersect(afterViews)
-		wsh.sendMessageToViews(agentMessageB, agentmovedinview) // sent only to Views
+		wsh.sendMessageToViews(agentMessageB, agentmovedinview, agent) // sent only to Views
 
 		agententeredview := afterViews.Difference(beforeViews)
-		wsh.sendMessageToConsumers(enterMessage, agententeredview)
+		wsh.sendMessageToConsumers(enterMessage, agententeredview, agent)
 
 	} else {
 		// TODO LATER factor with agententeredview
 		// we didn't need to determine a max view size ! rtrees rock
-		wsh.sendMessageToConsumersWithPoint(enterMessage, pos)
+		wsh.sendMessageToConsumersWithPoint(enterMessage, pos, agent)
 	}
 }
 
@@ -45,9 +47,8 @@ func (wsh *WSRouter) handleViewMove(view *View, pos *quad.Rect) {
 
 	// TODO LATER return if move was too small
 
-	// TODO implement WS ping pong
-
-	previousPos := wsh.db.updateViewPosition(*view.id, pos)
+	previousPos := wsh.db.updateViewPosition(view, pos)
+	tags := []string{view.name}
 
 	viewPointsAfter := wsh.db.getPointLikeIn(pos)
 
@@ -60,119 +61,260 @@ func (wsh *WSRouter) handleViewMove(view *View, pos *quad.Rect) {
 		added := viewPointsAfter.Difference(viewPointsBefore)
 
 		for _ag := range removed.Iter() {
-			if _ag == nil {
+			if _ag == nil || !view.filter.accepts(_ag.(filterable)) {
 				continue
 			}
 			ag := _ag.(JSONMessageAble)
 			message := ag.enterLeaveMessage(false)
-			view.ws.writeJSON(message)
+			view.ws.writeJSON(tagMessage(message, tags))
 		}
 
 		for _ag := range added.Iter() {
-			if _ag == nil {
+			if _ag == nil || !view.filter.accepts(_ag.(filterable)) {
 				continue
 			}
 			ag := _ag.(JSONMessageAble)
 			message := ag.enterLeaveMessage(true)
-			view.ws.writeJSON(message)
+			view.ws.writeJSON(tagMessage(message, tags))
 		}
 	} else {
 
 		for _ag := range viewPointsAfter.Iter() {
-			if _ag == nil {
+			if _ag == nil || !view.filter.accepts(_ag.(filterable)) {
 				continue
 			}
 			ag := _ag.(JSONMessageAble)
 			message := ag.enterLeaveMessage(true)
-			view.ws.writeJSON(message)
+			view.ws.writeJSON(tagMessage(message, tags))
 		}
 	}
 
 	// TODO handle AirBeacon and Event
 }
 
+// handleViewFilter replaces the filter of a view
+// objects in the view it doesn't accept anymore leave it, the ones it now accepts enter it
+func (wsh *WSRouter) handleViewFilter(view *View, filter *ViewFilter) {
+	previous := wsh.db.updateViewFilter(view, filter)
+	pos := view.GetRect()
+	if pos == nil {
+		return
+	}
+	tags := []string{view.name}
+
+	for _ag := range wsh.db.getPointLikeIn(pos).Iter() {
+		if _ag == nil {
+			continue
+		}
+		before, after := previous.accepts(_ag.(filterable)), filter.accepts(_ag.(filterable))
+		if before != after {
+			message := _ag.(JSONMessageAble).enterLeaveMessage(after)
+			view.ws.writeJSON(tagMessage(message, tags))
+		}
+	}
+}
+
 func (wsh *WSRouter) handleAgentPublicData(agent *Agent, pub map[string]interface{}) {
+	before := snapshot(agent)
 	agent.publicData = pub
 
-	message := &JSONAgent{}
+	if agent.GetPoint() == nil {
+		return
+	}
+
+	message := &JSONAgentEnteredLeft{} // neither entered nor left: an update
 	message.ID = agent.ID
 	message.Pos = agent.GetPoint()
 	message.PublicData = agent.publicData
-	wsh.sendMessageToConsumersWithPoint(message, agent.GetPoint())
+
+	// filtered views may start or stop accepting the agent
+	left, kept, entered := splitByFilter(wsh.db.getRectLikeWithPoint(agent.GetPoint()), before, agent)
+	wsh.sendMessageToConsumers(agent.enterLeaveMessage(false), left, before)
+	wsh.sendMessageToConsumers(message, kept, agent)
+	wsh.sendMessageToConsumers(agent.enterLeaveMessage(true), entered, agent)
 }
 
 func (wsh *WSRouter) handleAgentLeft(agent *Agent) {
 	message := &JSONAgentEnteredLeft{}
 	message.ID = agent.ID
 	message.Left = true
-	wsh.sendMessageToConsumersWithPoint(message, agent.GetPoint())
+	wsh.sendMessageToConsumersWithPoint(message, agent.GetPoint(), agent)
 }
 
-func (wsh *WSRouter) handlePOICreate(id *string, pos *quad.Point, publicData map[string]interface{}, creator *string) {
-	_, exists := wsh.db.pois[*id]
-	if exists {
-		// TODO error instead: poi_id already exists
-		log.Warnf("Poi %s already exists", *id)
-		return
+func (wsh *WSRouter) handlePOICreate(id *string, pos *quad.Point, publicData map[string]interface{}, creator *string, acl *ACL, expiresAt *time.Time) error {
+	if _, err := wsh.db.getPOI(*id); err == nil {
+		return ErrPOIExists
 	}
-	poi := wsh.db.addPOI(*id, pos, publicData, creator)
+	poi := wsh.db.addPOI(*id, pos, publicData, creator, acl, expiresAt)
 	message := poi.enterLeaveMessage(true)
-	wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint())
+	wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint(), poi)
+	return nil
 }
 
-func (wsh *WSRouter) handlePOIRemove(id *string, user *string) {
-	poi, exists := wsh.db.pois[*id]
-	if !exists {
-		return
+func (wsh *WSRouter) handlePOIRemove(id *string, token *JWTToken) error {
+	poi, err := wsh.db.getPOI(*id)
+	if err != nil {
+		return err
 	}
-	if user != nil && *poi.creator != *user { // TODO replace with ACL
-		// TODO send error
-		return
+	if !poi.acl.allowsOwner(token) {
+		return ErrForbidden
 	}
 	wsh.db.removePOI(poi)
 
 	message := poi.enterLeaveMessage(false)
-	wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint())
+	wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint(), poi)
+	return nil
+}
+
+// handlePOIExpired is called by the reaper after an expired POI is removed
+func (wsh *WSRouter) handlePOIExpired(poi *POI) {
+	message := poi.enterLeaveMessage(false)
+	wsh.sendMessageToConsumersWithPoint(message, poi.GetPoint(), poi)
+}
+
+// handlePOIUpdate moves a POI and/or replaces its publicData, ACL and expiry
+// views which see the POI before and after receive an update, the others see it enter or leave
+func (wsh *WSRouter) handlePOIUpdate(id *string, pos *quad.Point, publicData map[string]interface{}, acl *ACL, expiresAt *time.Time, token *JWTToken) (*POI, error) {
+	poi, err := wsh.db.getPOI(*id)
+	if err != nil {
+		return nil, err
+	}
+	if !poi.acl.allowsEdit(token) || (acl != nil && !poi.acl.allowsOwner(token)) {
+		return nil, ErrForbidden
+	}
+	if pos != nil {
+		if err := token.Capabilities.checkPoint(pos); err != nil {
+			return nil, err
+		}
+	}
+	before := snapshot(poi)
+	oldPosition := wsh.db.updatePOI(poi, pos, publicData, acl, expiresAt)
+
+	beforeViews := wsh.db.getRectLikeWithPoint(oldPosition)
+	afterViews := wsh.db.getRectLikeWithPoint(poi.GetPoint())
+
+	// filtered views which see the POI before and after may start or stop accepting it
+	left, kept, entered := splitByFilter(beforeViews.Intersect(afterViews), before, poi)
+	left = left.Union(beforeViews.Difference(afterViews))
+	entered = entered.Union(afterViews.Difference(beforeViews))
+
+	wsh.sendMessageToConsumers(poi.enterLeaveMessage(false), left, before)
+	wsh.sendMessageToViews(poi.updateMessage(), kept, poi) // sent only to Views
+	wsh.sendMessageToConsumers(poi.enterLeaveMessage(true), entered, poi)
+
+	return poi, nil
 }
-func (wsh *WSRouter) handleAirBeaconCreate(id *string, pos *quad.Rect, publicData map[string]interface{}, creator *string) {
+
+func (wsh *WSRouter) handleAirBeaconCreate(id *string, pos *quad.Rect, shape quad.Shape, publicData map[string]interface{}, creator *string, acl *ACL) error {
+	wsh.db.RLock()
 	_, exists := wsh.db.ab[*id]
+	wsh.db.RUnlock()
 	if exists {
-		// TODO error instead: ab_id already exists
-		log.Warnf("AirBeacon %s already exists", *id)
-		return
+		return ErrAirBeaconExists
 	}
-	wsh.db.addAirBeacon(*id, pos, publicData, creator)
+	wsh.db.addAirBeacon(*id, pos, shape, publicData, creator, acl)
+	return nil
 }
 
-func (wsh *WSRouter) handleAirBeaconRemove(id *string, user *string) {
+func (wsh *WSRouter) handleAirBeaconRemove(id *string, token *JWTToken) error {
+	wsh.db.RLock()
 	ab, exists := wsh.db.ab[*id]
+	wsh.db.RUnlock()
 	if !exists {
-		// TODO return error
-		return
+		return ErrAirBeaconNotFound
 	}
-	if user != nil && *ab.creator != *user { // TODO replace with ACL
-		// TODO send error
-		return
+	if !ab.acl.allowsOwner(token) {
+		return ErrForbidden
 	}
 	wsh.db.removeAirBeacon(*id)
+	return nil
 }
 
-func (wsh *WSRouter) sendMessageToConsumersWithPoint(message JSONChangeMessage, point *quad.Point) {
+// handleEvent delivers an event to the Views intersecting its bounding box, and to the Agents within its radius
+// each connection receives the event only once, if it can receive events
+func (wsh *WSRouter) handleEvent(event *JSONEvent) {
+	area := quad.Circle{Center: *event.Pos, Radius: event.Radius}.BoundingRect()
+
+	receivers := make(map[*wsConn]bool)
+	for each := range wsh.db.getViewsIntersecting(&area).Iter() {
+		if view, ok := each.(*View); ok {
+			receivers[view.ws] = true
+		}
+	}
+	for each := range wsh.db.getPointLikeWithinRadius(event.Pos, event.Radius).Iter() {
+		if agent, ok := each.(*Agent); ok {
+			receivers[agent.ws] = true
+		}
+	}
+
+	message := &JSONEventMessage{Event: event}
+	for ws := range receivers {
+		if ws.receivesEvents() {
+			ws.writeJSON(message)
+		}
+	}
+}
+
+func (wsh *WSRouter) handleSendMessage(from *Agent, msg *JSONMessage) error {
+	to, err := wsh.db.getAgent(*msg.To)
+	if err != nil {
+		return err
+	}
+	if MaxMessageDistance > 0 {
+		fromPos, toPos := from.GetPoint(), to.GetPoint()
+		if fromPos == nil || toPos == nil || fromPos.DistanceTo(toPos) > MaxMessageDistance {
+			return ErrAgentTooFar
+		}
+	}
+	to.ws.writeJSON(&JSONDirectMessage{Message: &JSONMessage{From: from.ID, Payload: msg.Payload}})
+	return nil
+}
+
+// handleNearest sends the nearest agents and POIs within the largest radius allowed by capabilities, and in its regions
+func (wsh *WSRouter) handleNearest(ws *wsConn, query *JSONNearest, self *Agent, capabilities *JWTTokenCaps) {
+	acceptor := func(each quad.PointLike) bool {
+		if !capabilities.allowsPoint(each.GetPoint()) {
+			return false
+		}
+		switch pointLike := each.(type) {
+		case *Agent:
+			return pointLike != self && query.Type != "poi"
+		case *POI:
+			return query.Type != "agent"
+		}
+		return false
+	}
+
+	nearest := wsh.db.getNearestPointLike(query.Pos, query.K, capabilities.maxRadius(), acceptor)
+	res := make([]interface{}, 0, len(nearest))
+	for _, each := range nearest {
+		res = append(res, pointLikeToJSON(each))
+	}
+	ws.writeImmediateJSON(struct {
+		Nearest []interface{} `json:"nearest"`
+	}{res})
+}
+
+func (wsh *WSRouter) sendMessageToConsumersWithPoint(message JSONChangeMessage, point *quad.Point, subject filterable) {
 	if point == nil {
 		return
 	}
 	views := wsh.db.getRectLikeWithPoint(point)
-	wsh.sendMessageToConsumers(message, views)
+	wsh.sendMessageToConsumers(message, views, subject)
 }
 
-func (wsh *WSRouter) sendMessageToConsumers(message JSONChangeMessage, consumers set.Set) {
+// sendMessageToConsumers sends a message about subject to AirBeacons, and to the Views whose filter accepts subject
+func (wsh *WSRouter) sendMessageToConsumers(message JSONChangeMessage, consumers set.Set, subject filterable) {
+	viewsByConn := make(map[*wsConn][]string)
 	for each := range consumers.Iter() {
 		if each == nil { // BUG strange I need it under load
 			continue
 		}
 		switch consumer := each.(type) {
 		case *View:
-			consumer.ws.writeJSON(message)
+			if consumer.filter.accepts(subject) {
+				viewsByConn[consumer.ws] = append(viewsByConn[consumer.ws], consumer.name)
+			}
 		case *AirBeacon:
 			if wsh.whw != nil {
 				msg := HookMessage{AirBeacon: *consumer.id, Message: message}
@@ -180,15 +322,51 @@ func (wsh *WSRouter) sendMessageToConsumers(message JSONChangeMessage, consumers
 			}
 		}
 	}
+	writeTaggedMessage(message, viewsByConn)
 }
 
-func (wsh *WSRouter) sendMessageToViews(message JSONChangeMessage, consumers set.Set) {
+func (wsh *WSRouter) sendMessageToViews(message JSONChangeMessage, consumers set.Set, subject filterable) {
+	viewsByConn := make(map[*wsConn][]string)
 	for each := range consumers.Iter() {
 		if each == nil { // BUG strange I need it under load
 			continue
 		}
-		if view, ok := each.(*View); ok {
-			view.ws.writeJSON(message)
+		if view, ok := each.(*View); ok && view.filter.accepts(subject) {
+			viewsByConn[view.ws] = append(viewsByConn[view.ws], view.name)
+		}
+	}
+	writeTaggedMessage(message, viewsByConn)
+}
+
+// splitByFilter splits consumers which see an object before and after a change of its publicData
+// into the ones which stop accepting it, the ones which keep accepting it and the ones which start accepting it
+// AirBeacons aren't filtered, they're always kept
+func splitByFilter(consumers set.Set, before, after filterable) (left, kept, entered set.Set) {
+	left, kept, entered = set.NewThreadUnsafeSet(), set.NewThreadUnsafeSet(), set.NewThreadUnsafeSet()
+	for each := range consumers.Iter() {
+		view, ok := each.(*View)
+		if !ok {
+			if each != nil {
+				kept.Add(each)
+			}
+			continue
 		}
+		acceptedBefore, acceptedAfter := view.filter.accepts(before), view.filter.accepts(after)
+		switch {
+		case acceptedBefore && acceptedAfter:
+			kept.Add(view)
+		case acceptedBefore:
+			left.Add(view)
+		case acceptedAfter:
+			entered.Add(view)
+		}
+	}
+	return
+}
+
+// writeTaggedMessage sends a message once per websocket, tagged with the websocket's views that should receive it
+func writeTaggedMessage(message JSONChangeMessage, viewsByConn map[*wsConn][]string) {
+	for ws, views := range viewsByConn {
+		ws.writeJSON(tagMessage(message, views))
 	}
 }
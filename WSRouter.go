@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"expvar"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,29 +15,112 @@ var (
 	MessageSendInterval = 1000 * time.Millisecond
 	// ShowOwnAgent determines if messages for my view can include myself if I'm also an agent
 	ShowOwnAgent = true // TODO LATER handle false too...
-
-	activeConnections *expvar.Int
+	// MaxNearestResults is the largest number of results for a nearest search
+	MaxNearestResults = 100
+	// MaxMessageDistance is the largest distance in meters between agents sending messages, 0 for no limit
+	MaxMessageDistance = 0.0
+	// PingInterval determines how often clients are pinged, 0 to disable pings and read deadlines
+	PingInterval = 20 * time.Second
+	// ResumeGracePeriod is how long a session is kept after its websocket is lost, 0 to disable resuming sessions
+	ResumeGracePeriod = 30 * time.Second
+	// MaxResumeBuffer is the max number of messages kept for a suspended session
+	MaxResumeBuffer = 1000
+	// MaxQueuedMessages is the max number of messages waiting to be written to a websocket, before OverflowPolicy applies
+	MaxQueuedMessages = 1000
+	// OverflowPolicy is what happens when a client doesn't read its messages fast enough: OverflowCoalesce, OverflowDrop or OverflowDisconnect
+	OverflowPolicy = OverflowCoalesce
+	// WriteWait is how long writing a message can take before the websocket is considered lost
+	WriteWait = 10 * time.Second
+	// DefaultRateLimits limits commands by name, unless the JWT token has its own limits
+	DefaultRateLimits = map[string]RateLimit{
+		"agentPosition":   {Rate: 20, Burst: 40},
+		"viewPosition":    {Rate: 20, Burst: 40},
+		"moveView":        {Rate: 20, Burst: 40},
+		"addView":         {Rate: 5, Burst: 10},
+		"removeView":      {Rate: 5, Burst: 10},
+		"publicData":      {Rate: 5, Burst: 10},
+		"createPOI":       {Rate: 10, Burst: 20},
+		"updatePOI":       {Rate: 10, Burst: 20},
+		"removePOI":       {Rate: 10, Burst: 20},
+		"createAirBeacon": {Rate: 5, Burst: 10},
+		"removeAirBeacon": {Rate: 5, Burst: 10},
+		"sendEvent":       {Rate: 10, Burst: 20},
+		"sendMessage":     {Rate: 10, Burst: 20},
+		"nearest":         {Rate: 5, Burst: 10},
+		"refreshToken":    {Rate: 1, Burst: 5},
+	}
+	// TokenExpiryWarning is how long before its token expires a client is warned, 0 to disable warnings
+	TokenExpiryWarning = 60 * time.Second
+	// MaxRateLimitHits is the number of commands over the rate limits, within RateLimitWindow, before a client is disconnected, 0 to never disconnect
+	MaxRateLimitHits = 50
+	// RateLimitWindow is the window for MaxRateLimitHits
+	RateLimitWindow = 10 * time.Second
+	// PongWait is how long we wait for a pong before dropping a connection, it must be larger than PingInterval
+	// other messages read from the client don't extend it
+	PongWait = 45 * time.Second
+
+	activeConnections       *expvar.Int
+	idleDisconnections      *expvar.Int
+	overflowCoalesced       *expvar.Int
+	overflowDropped         *expvar.Int
+	overflowDisconnections  *expvar.Int
+	rateLimited             *expvar.Map // by command
+	rateLimitDisconnections *expvar.Int
 )
 
 var (
 	// ErrAgentExists is returned if the Agent ID is already used
-	ErrAgentExists = errors.New("Agent ID already exists")
+	ErrAgentExists = newError(CodeAgentExists, http.StatusConflict, "Agent ID already exists")
 	// ErrViewExists is returned if the View ID is already used
-	ErrViewExists = errors.New("View ID already exists")
-	// ErrInvalidMessage is returned if the json message can't be parsed
-	ErrInvalidMessage = errors.New("Invalid message format")
+	ErrViewExists = newError(CodeViewExists, http.StatusConflict, "View ID already exists")
+	// ErrTooManyViews is returned when adding more views than the JWT token allows
+	ErrTooManyViews = newError(CodeTooManyViews, http.StatusBadRequest, "Too many views: you can't have more than what your JWT Token allows")
+	// ErrViewTooLarge is returned when a view is larger than the JWT token allows
+	ErrViewTooLarge = newError(CodeViewTooLarge, http.StatusBadRequest, "View size error: it can't be larger than what your JWT Token allows")
+	// ErrAirBeaconTooLarge is returned when an AirBeacon is larger than the JWT token allows
+	ErrAirBeaconTooLarge = newError(CodeAirBeaconTooLarge, http.StatusBadRequest, "Air Beacon size error: it can't be larger than what your JWT Token allows")
+	// ErrOutsideRegion is returned when an agent, view, POI or AirBeacon is placed outside the regions the JWT token allows
+	ErrOutsideRegion = newError(CodeOutsideRegion, http.StatusForbidden, "Region error: it can't be placed outside of the regions your JWT Token allows")
+	// ErrInvalidMessage is returned if the message can't be parsed
+	ErrInvalidMessage = newError(CodeInvalidCommand, http.StatusBadRequest, "Invalid message format")
+	// ErrInvalidCommand is returned if the command isn't valid
+	ErrInvalidCommand = newError(CodeInvalidCommand, http.StatusBadRequest, "Invalid command")
+	// ErrResumeFailed is returned when a session can't be resumed
+	ErrResumeFailed = newError(CodeResumeFailed, http.StatusGone, "Session can't be resumed")
+	// ErrSlowConsumer is the reason websockets are closed when the client doesn't read its messages fast enough
+	ErrSlowConsumer = newError(CodeSlowConsumer, http.StatusServiceUnavailable, "Too many messages waiting to be sent")
+	// ErrRateLimited is returned when a command exceeds its rate limit
+	ErrRateLimited = newError(CodeRateLimited, http.StatusTooManyRequests, "Too many commands, slow down")
+	// ErrRadiusTooLarge is returned when a radius query is larger than the JWT token allows
+	ErrRadiusTooLarge = newError(CodeRadiusTooLarge, http.StatusBadRequest, "Radius error: it can't be larger than what your JWT Token allows")
+	// ErrMethodNotAllowed is returned for HTTP methods an endpoint doesn't support
+	ErrMethodNotAllowed = newError(CodeMethodNotAllowed, http.StatusMethodNotAllowed, "HTTP method not allowed")
+	// ErrMessageTooLarge is returned if the message exceeds geeo's limits
+	ErrMessageTooLarge = newError(CodeMessageTooLarge, http.StatusRequestEntityTooLarge, "Message too large")
 )
 
 // WSRouter holds what a WS handler needs to work
 type WSRouter struct {
 	db  *GeeoDB
 	whw *WebhookWriter
+
+	sessions     map[string]*wsSession // live and suspended sessions, by resume token
+	sessionsLock sync.Mutex
+
+	limiters     map[limiterKey]*rateLimiter // shared by the sessions of the same agent and view
+	limitersLock sync.Mutex
 }
 
 // NewWSRouter returns a new WSRouter
 func NewWSRouter(db *GeeoDB, whw *WebhookWriter) *WSRouter {
-	newwsh := WSRouter{db: db, whw: whw}
+	newwsh := WSRouter{db: db, whw: whw, sessions: make(map[string]*wsSession), limiters: make(map[limiterKey]*rateLimiter)}
 	activeConnections = expvar.NewInt("active_connections")
+	idleDisconnections = expvar.NewInt("idle_disconnections")
+	overflowCoalesced = expvar.NewInt("overflow_coalesced")
+	overflowDropped = expvar.NewInt("overflow_dropped")
+	overflowDisconnections = expvar.NewInt("overflow_disconnections")
+	rateLimited = expvar.NewMap("rate_limited")
+	rateLimitDisconnections = expvar.NewInt("rate_limit_disconnections")
 
 	return &newwsh
 }
@@ -48,7 +131,6 @@ func (wsh *WSRouter) handle(upgrader websocket.Upgrader) func(http.ResponseWrite
 	// if the token is sent and is valid, we'll proceed
 	// this function runs in its own goroutine. If it ever ends, the connection is dropped
 	return func(res http.ResponseWriter, req *http.Request) {
-		var identity string
 
 		activeConnections.Add(1)
 		defer func() {
@@ -66,54 +148,71 @@ func (wsh *WSRouter) handle(upgrader websocket.Upgrader) func(http.ResponseWrite
 			t = req.URL.Query().Get("token")
 		}
 
+		// the subprotocol was negotiated by the upgrader
+		codec := codecFor(conn.Subprotocol())
+
+		// the token's capabilities are checked too
 		token, err := parseJWTToken(t)
 		if err != nil {
-			message := struct {
-				Error   string `json:"error"`
-				Message string `json:"message"`
-			}{"Can't parse token, or token invalid", err.Error()}
-			conn.WriteJSON(message)
+			message := tokenError(err).toJSON()
+			if data, err := codec.marshal(message); err == nil {
+				conn.WriteMessage(codec.messageType(), data)
+			}
 			log.Warn("Can't parse token, or token invalid: ", err.Error())
 			return
 		}
 
 		// TODO LATER connectionWebHook
 
-		var agent *Agent
-		var view *View
-
-		capabilities := token.Capabilities
-		// TODO check MaxView and MaxAirBeacon
-
-		wsConn := newWSConn(conn)
-		if capabilities.Produce {
-			agent = wsh.db.addAgent(token.AgentID, wsConn, token.Public)
-			identity = "agent:" + token.AgentID
+		var session *wsSession
+		resumed := false
+		if resumeToken := req.URL.Query().Get("resume"); resumeToken != "" && ResumeGracePeriod > 0 {
+			session, err = wsh.resumeSession(resumeToken, token, conn, codec)
+			if err != nil {
+				// the client gets a new session instead
+				message := asGeeoError(err).toJSON()
+				if data, err := codec.marshal(message); err == nil {
+					conn.WriteMessage(codec.messageType(), data)
+				}
+				log.Info("Can't resume session of agent ", token.AgentID, ", view ", token.ViewID)
+			}
+			resumed = err == nil
 		}
-		if capabilities.Consume {
-			view = wsh.db.addView(token.ViewID, wsConn)
-			identity = "view:" + token.ViewID
+		if !resumed {
+			if ResumeGracePeriod > 0 {
+				wsh.closeSuspendedSessions(token)
+			}
+			ws := newWSConn(conn, codec, token.Capabilities.ReceiveEvents)
+			session, err = newWSSession(wsh, ws, token)
+			if err != nil {
+				ws.writeImmediateJSON(asGeeoError(err).toJSON())
+				ws.close() // once the error is written
+				log.Info("Can't start a session for agent ", token.AgentID, ", view ", token.ViewID, ": ", err.Error())
+				return
+			}
+			wsh.registerSession(session)
 		}
-		if capabilities.Produce && capabilities.Consume {
-			identity = "agent:" + token.AgentID + "+view:" + token.ViewID
+		identity := session.identity
+		log.Debug("login: ", identity, ", resumed: ", resumed)
+
+		if ResumeGracePeriod > 0 {
+			session.ws.writeImmediateJSON(session.sessionMessage(resumed))
+			session.ws.Flush() // messages missed while suspended
 		}
-		log.Debug("login: ", identity)
 
-		wsConn.Name = identity
+		if PingInterval > 0 {
+			session.ws.keepAlive(PingInterval, PongWait)
+		}
 
+		// sessions are suspended when the websocket is lost, unless the client left
+		left := false
 		defer func() {
 			if err := recover(); err != nil {
 				log.Error(err)
+				left = true
 			}
-			log.Debug("logout: ", identity)
-			if agent != nil {
-				wsh.db.removeAgent(*agent.ID)
-				wsh.handleAgentLeft(agent)
-			}
-			if view != nil {
-				wsh.db.removeView(token.ViewID)
-			}
-			wsConn.close()
+			log.Debug("logout: ", identity, ", left: ", left)
+			wsh.endConnection(session, conn, left)
 			// TODO LATER defer deconnectionWebHook
 		}()
 
@@ -122,108 +221,58 @@ func (wsh *WSRouter) handle(upgrader websocket.Upgrader) func(http.ResponseWrite
 		command := JSONCommand{}
 
 		for {
-			_, jsonString, err := conn.ReadMessage()
+			_, data, err := conn.ReadMessage()
 			if err != nil {
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					left = true
 					return
 				}
 				if websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
-					wsConn.writeImmediateJSON(struct {
-						Error   string `json:"error"`
-						Message string `json:"message"`
-					}{"Message too large", "Your message size exceeds geeo's limits"})
+					left = true
+					session.ws.writeImmediateJSON(ErrMessageTooLarge.withDetail("Your message size exceeds geeo's limits").toJSON())
 					log.Warn(identity, ": Message too large")
 					// TODO LATER monitor read error rate
 					return
 				}
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					idleDisconnections.Add(1)
+					log.Info(identity, ": no pong received, disconnecting")
+					return
+				}
 				log.Warn(identity, ": ", err.Error())
 				return
 			}
 
-			command.clear()
-			if err := json.Unmarshal(jsonString, &command); err != nil {
-				wsConn.writeImmediateJSON(struct {
-					Error   string `json:"error"`
-					Message string `json:"message"`
-				}{"Can't parse command (" + string(jsonString) + ")", err.Error()})
-				log.Warn(identity, ": invalid JSON command")
-			}
-
-			if err := command.check(); err != nil {
-				wsConn.writeImmediateJSON(struct {
-					Error   string `json:"error"`
-					Message string `json:"message"`
-				}{"Invalid Command (" + string(jsonString) + ")", err.Error()})
-				log.Warn(identity, ": invalid command")
-			}
-
-			log.Debug(identity, ": ", string(jsonString))
-
-			if command.AgentPosition != nil && capabilities.Produce {
-				wsh.handleAgentMove(agent, command.AgentPosition)
-				// TODO LATER monitor move rate
-			}
-
-			if command.ViewPosition != nil && capabilities.Consume {
-				viewSize := command.ViewPosition.Size()
-				if viewSize[0] > capabilities.MaxView[0] || viewSize[1] > capabilities.MaxView[1] {
-					wsConn.writeImmediateJSON(struct {
-						Error string `json:"error"`
-					}{"View size error: it can't be larger than what your JWT Token allows"})
-					log.Warn(identity, ": View size error")
-				} else {
-					//view.ws.Flush()
-					wsh.handleViewMove(view, command.ViewPosition)
-					// TODO LATER monitor move rate
-				}
+			// binary commands aren't printable
+			printable := "binary"
+			if codec.messageType() == websocket.TextMessage {
+				printable = string(data)
 			}
 
-			if command.AgentPublicData != nil && capabilities.Produce {
-				wsh.handleAgentPublicData(agent, command.AgentPublicData)
-				// TODO LATER monitor change rate
+			command.clear()
+			if err := codec.unmarshal(data, &command); err != nil {
+				session.ws.writeImmediateJSON(ErrInvalidMessage.withDetail(err.Error()).toJSON())
+				log.Warn(identity, ": invalid command encoding (", printable, ")")
+				continue
 			}
 
-			if command.CreatePOI != nil && capabilities.POI {
-				var creator *string
-				if agent != nil {
-					creator = agent.ID
-				}
-				wsh.handlePOICreate(command.CreatePOI.ID, command.CreatePOI.Pos, command.CreatePOI.PublicData, creator)
+			if err := command.check(); err != nil {
+				session.writeError(&command, "", invalidCommand(err))
+				log.Debug(identity, ": invalid command (", printable, ")")
+				continue
 			}
 
-			if command.RemovePOI != nil && capabilities.POI {
-				var user *string
-				if agent != nil {
-					user = agent.ID
-				}
-				wsh.handlePOIRemove(command.RemovePOI.ID, user)
-			}
+			log.Debug(identity, ": ", printable)
 
-			if command.CreateAirBeacon != nil && capabilities.AirBeacon {
-				abSize := command.CreateAirBeacon.Pos.Size()
-				if abSize[0] > capabilities.MaxAirBeacon[0] || abSize[1] > capabilities.MaxAirBeacon[1] {
-					wsConn.writeImmediateJSON(struct {
-						Error string `json:"error"`
-					}{"Air Beacon size error: it can't be larger than what your JWT Token allows"})
-					log.Warn(identity, ": AirBeacon size error")
-				} else {
-					var creator *string
-					if agent != nil {
-						creator = agent.ID
-					}
-					wsh.handleAirBeaconCreate(command.CreateAirBeacon.ID, command.CreateAirBeacon.Pos, command.CreateAirBeacon.PublicData, creator)
-				}
-			}
+			session.handleCommand(&command)
 
-			if command.RemoveAirBeacon != nil && capabilities.AirBeacon {
-				var user *string
-				if agent != nil {
-					user = agent.ID
-				}
-				wsh.handleAirBeaconRemove(command.RemoveAirBeacon.ID, user)
+			if session.limiter.abusive() {
+				rateLimitDisconnections.Add(1)
+				log.Warn(identity, ": too many commands over the rate limits, disconnecting")
+				session.ws.drop(ErrRateLimited.Code)
+				left = true
+				return
 			}
-
-			// TODO LATER log errors trying to perform action without capabilities
 		}
 	}
 }
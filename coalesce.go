@@ -0,0 +1,164 @@
+package main
+
+import "strings"
+
+// changes about agents and POIs, as far as coalescing is concerned
+type changeKind int
+
+const (
+	changeOther  changeKind = iota // not about an agent or POI, never coalesced
+	changeMove                     // an agent's new position
+	changeUpdate                   // a new position and publicData
+	changeEnter
+	changeLeave
+)
+
+// lastChange locates the last buffered change about an agent or POI
+type lastChange struct {
+	views string // the views the change was tagged with
+	index int    // in the buffer
+}
+
+// changeOf returns the agent or POI a message is about, the views it's tagged with, and the kind of change
+func changeOf(msg JSONChangeMessage) (id string, views string, kind changeKind) {
+	switch m := msg.(type) {
+	case *AgentMoveMessage:
+		if m.ID != nil {
+			return "agent:" + *m.ID, strings.Join(m.Views, ","), changeMove
+		}
+	case *JSONAgentEnteredLeft:
+		if m.ID != nil {
+			return "agent:" + *m.ID, strings.Join(m.Views, ","), kindOf(&m.EnteredLeft)
+		}
+	case *JSONPOIEnteredLeft:
+		if m.ID != nil {
+			return "poi:" + *m.ID, strings.Join(m.Views, ","), kindOf(&m.EnteredLeft)
+		}
+	}
+	return "", "", changeOther
+}
+
+func kindOf(e *EnteredLeft) changeKind {
+	switch {
+	case e.Entered:
+		return changeEnter
+	case e.Left:
+		return changeLeave
+	}
+	return changeUpdate
+}
+
+// merge returns the change equivalent to previous followed by msg, about the same agent or POI and views
+// it returns nil if they cancel out, and false if they can't be merged
+func merge(previous JSONChangeMessage, previousKind changeKind, msg JSONChangeMessage, kind changeKind) (JSONChangeMessage, bool) {
+	switch previousKind {
+	case changeEnter:
+		switch kind {
+		case changeLeave:
+			return nil, true
+		case changeMove:
+			return movedTo(previous, msg), true
+		case changeUpdate:
+			return withEnteredLeft(msg, EnteredLeft{Entered: true}), true
+		}
+	case changeLeave:
+		if kind == changeEnter {
+			return withEnteredLeft(msg, EnteredLeft{}), true
+		}
+	case changeMove:
+		if kind == changeMove || kind == changeUpdate || kind == changeLeave {
+			return msg, true
+		}
+	case changeUpdate:
+		switch kind {
+		case changeMove:
+			return movedTo(previous, msg), true // keeps publicData
+		case changeUpdate, changeLeave:
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+// withEnteredLeft returns a copy of an agent or POI message, entering, leaving or updating
+func withEnteredLeft(msg JSONChangeMessage, e EnteredLeft) JSONChangeMessage {
+	switch m := msg.(type) {
+	case *JSONAgentEnteredLeft:
+		merged := *m
+		merged.EnteredLeft = e
+		return &merged
+	case *JSONPOIEnteredLeft:
+		merged := *m
+		merged.EnteredLeft = e
+		return &merged
+	}
+	return msg
+}
+
+// movedTo returns a copy of an agent's enter or update message, at the position of move
+func movedTo(msg JSONChangeMessage, move JSONChangeMessage) JSONChangeMessage {
+	m, ok := msg.(*JSONAgentEnteredLeft)
+	mv, isMove := move.(*AgentMoveMessage)
+	if !ok || !isMove {
+		return move
+	}
+	merged := *m
+	merged.Pos = mv.Point
+	return &merged
+}
+
+// coalesce merges msg with the last buffered change about the same agent or POI, if it's tagged with the same views
+// it must be called with the lock held, and returns false if msg must be buffered
+func (ws *wsConn) coalesce(msg JSONChangeMessage) bool {
+	id, views, kind := changeOf(msg)
+	if kind == changeOther {
+		return false
+	}
+	last, found := ws.lastChanges[id]
+	if !found || last.views != views {
+		return false
+	}
+	previous := ws.buffer[last.index]
+	_, _, previousKind := changeOf(previous)
+	merged, ok := merge(previous, previousKind, msg, kind)
+	if !ok {
+		return false
+	}
+
+	// the merged change replaces the previous one, at the end of the buffer
+	ws.buffer[last.index] = nil
+	ws.removed++
+	delete(ws.lastChanges, id)
+	if merged != nil {
+		ws.bufferChange(merged)
+	}
+	return true
+}
+
+// bufferChange adds msg to the buffer, it must be called with the lock held
+func (ws *wsConn) bufferChange(msg JSONChangeMessage) {
+	ws.buffer = append(ws.buffer, msg)
+	if id, views, kind := changeOf(msg); kind != changeOther {
+		if ws.lastChanges == nil {
+			ws.lastChanges = make(map[string]lastChange)
+		}
+		ws.lastChanges[id] = lastChange{views: views, index: len(ws.buffer) - 1}
+	}
+}
+
+// compact removes the changes which were merged from the buffer, it must be called with the lock held
+// changes can't be coalesced with the ones buffered before anymore
+func (ws *wsConn) compact() {
+	ws.lastChanges = nil
+	if ws.removed == 0 {
+		return
+	}
+	buffer := ws.buffer[:0]
+	for _, msg := range ws.buffer {
+		if msg != nil {
+			buffer = append(buffer, msg)
+		}
+	}
+	ws.buffer = buffer
+	ws.removed = 0
+}
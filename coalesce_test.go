@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"geeo.io/GeeoServer/quad"
+)
+
+func agentChange(id string, x float64, e EnteredLeft, views ...string) *JSONAgentEnteredLeft {
+	return &JSONAgentEnteredLeft{JSONAgent: JSONAgent{ID: &id, Pos: &quad.Point{x, 0}}, EnteredLeft: e, ViewTags: ViewTags{views}}
+}
+
+func agentUpdate(id string, x float64, data string, views ...string) *JSONAgentEnteredLeft {
+	m := agentChange(id, x, EnteredLeft{}, views...)
+	m.PublicData = map[string]interface{}{"data": data}
+	return m
+}
+
+func agentMove(id string, x float64, views ...string) *AgentMoveMessage {
+	return &AgentMoveMessage{ID: &id, Point: &quad.Point{x, 0}, ViewTags: ViewTags{views}}
+}
+
+func poiChange(id string, x float64, e EnteredLeft) *JSONPOIEnteredLeft {
+	return &JSONPOIEnteredLeft{JSONPOI: JSONPOI{ID: &id, Pos: &quad.Point{x, 0}}, EnteredLeft: e}
+}
+
+var (
+	entered = EnteredLeft{Entered: true}
+	left    = EnteredLeft{Left: true}
+)
+
+// buffer adds changes like writeJSON does before the buffer is flushed
+func buffer(ws *wsConn, changes ...JSONChangeMessage) {
+	for _, change := range changes {
+		if !ws.coalesce(change) {
+			ws.bufferChange(change)
+		}
+	}
+}
+
+func buffered(t *testing.T, ws *wsConn) string {
+	ws.compact()
+	res, err := json.Marshal(ws.buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(res)
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  []JSONChangeMessage
+		expected string
+	}{
+		{"enter and leave cancel out",
+			[]JSONChangeMessage{agentChange("a", 1, entered, "v"), agentChange("a", 1, left, "v")},
+			`[]`},
+		{"leave and enter become an update",
+			[]JSONChangeMessage{agentChange("a", 1, left, "v"), agentChange("a", 2, entered, "v")},
+			`[{"agent_id":"a","pos":[2,0],"views":["v"]}]`},
+		{"enter then move enters at the new position",
+			[]JSONChangeMessage{agentChange("a", 1, entered, "v"), agentMove("a", 2, "v")},
+			`[{"agent_id":"a","pos":[2,0],"entered":true,"views":["v"]}]`},
+		{"enter then update enters with the update",
+			[]JSONChangeMessage{agentChange("a", 1, entered), agentUpdate("a", 2, "x")},
+			`[{"agent_id":"a","pos":[2,0],"publicData":{"data":"x"},"entered":true}]`},
+		{"moves keep the last position",
+			[]JSONChangeMessage{agentMove("a", 1), agentMove("a", 2), agentMove("a", 3)},
+			`[{"agent_id":"a","pos":[3,0]}]`},
+		{"move after update keeps publicData",
+			[]JSONChangeMessage{agentUpdate("a", 1, "x"), agentMove("a", 2)},
+			`[{"agent_id":"a","pos":[2,0],"publicData":{"data":"x"}}]`},
+		{"move then leave only leaves",
+			[]JSONChangeMessage{agentMove("a", 1), agentChange("a", 1, left)},
+			`[{"agent_id":"a","pos":[1,0],"left":true}]`},
+		{"leave then move aren't merged",
+			[]JSONChangeMessage{agentChange("a", 1, left), agentMove("a", 2)},
+			`[{"agent_id":"a","pos":[1,0],"left":true},{"agent_id":"a","pos":[2,0]}]`},
+		{"different view tags aren't merged",
+			[]JSONChangeMessage{agentMove("a", 1, "v"), agentMove("a", 2, "w")},
+			`[{"agent_id":"a","pos":[1,0],"views":["v"]},{"agent_id":"a","pos":[2,0],"views":["w"]}]`},
+		{"different agents aren't merged",
+			[]JSONChangeMessage{agentChange("a", 1, entered), agentChange("b", 1, left)},
+			`[{"agent_id":"a","pos":[1,0],"entered":true},{"agent_id":"b","pos":[1,0],"left":true}]`},
+		{"merged changes move to the end of the buffer",
+			[]JSONChangeMessage{agentMove("a", 1), agentMove("b", 1), agentMove("a", 2)},
+			`[{"agent_id":"b","pos":[1,0]},{"agent_id":"a","pos":[2,0]}]`},
+		{"POI enter and leave cancel out",
+			[]JSONChangeMessage{poiChange("p", 1, entered), poiChange("p", 1, left)},
+			`[]`},
+		{"POI leave and enter become an update",
+			[]JSONChangeMessage{poiChange("p", 1, left), poiChange("p", 2, entered)},
+			`[{"poi_id":"p","pos":[2,0]}]`},
+		{"agents and POIs with the same id aren't merged",
+			[]JSONChangeMessage{agentChange("a", 1, entered), poiChange("a", 1, left)},
+			`[{"agent_id":"a","pos":[1,0],"entered":true},{"poi_id":"a","pos":[1,0],"left":true}]`},
+		{"other messages are kept",
+			[]JSONChangeMessage{&JSONEventMessage{}, &JSONEventMessage{}},
+			`[{"event":null},{"event":null}]`},
+	}
+	for _, test := range tests {
+		ws := &wsConn{}
+		buffer(ws, test.changes...)
+		if res := buffered(t, ws); res != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, res, test.expected)
+		}
+	}
+}
+
+func TestCoalesceAfterCompact(t *testing.T) {
+	ws := &wsConn{}
+	buffer(ws, agentMove("a", 1), agentMove("a", 2))
+	ws.compact()
+	if ws.removed != 0 || len(ws.buffer) != 1 {
+		t.Fatalf("compact left %d removed changes in %v", ws.removed, ws.buffer)
+	}
+
+	// changes buffered before compact aren't merged anymore
+	buffer(ws, agentMove("a", 3))
+	expected := `[{"agent_id":"a","pos":[2,0]},{"agent_id":"a","pos":[3,0]}]`
+	if res := buffered(t, ws); res != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+}
+
+func TestCoalesceRequeue(t *testing.T) {
+	ws := &wsConn{detached: true} // not flushed
+	buffer(ws, agentMove("b", 1), agentChange("a", 1, entered), agentMove("b", 2))
+
+	// a failed write puts its changes back before the buffered ones
+	ws.requeue([]interface{}{[]JSONChangeMessage{agentMove("c", 1)}, "not a change"})
+	if ws.removed != 0 || ws.lastChanges != nil {
+		t.Fatalf("requeue kept %d removed changes and %v", ws.removed, ws.lastChanges)
+	}
+
+	// the indexes of the buffered changes moved, they aren't merged anymore
+	buffer(ws, agentChange("a", 1, left))
+	expected := `[{"agent_id":"c","pos":[1,0]},{"agent_id":"a","pos":[1,0],"entered":true},{"agent_id":"b","pos":[2,0]},{"agent_id":"a","pos":[1,0],"left":true}]`
+	if res := buffered(t, ws); res != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// websocket subprotocols, clients choose their encoding with the Sec-WebSocket-Protocol header
+const (
+	jsonSubprotocol    = "geeo-json"
+	msgpackSubprotocol = "geeo-msgpack"
+)
+
+// Subprotocols lists the supported subprotocols, by order of preference
+// clients which don't ask for a subprotocol use JSON
+var Subprotocols = []string{msgpackSubprotocol, jsonSubprotocol}
+
+// codec encodes the messages sent to a websocket, and decodes the commands it receives
+type codec interface {
+	messageType() int
+	marshal(v interface{}) ([]byte, error)
+	unmarshal(data []byte, v interface{}) error
+}
+
+// codecFor returns the codec of a negotiated subprotocol
+func codecFor(subprotocol string) codec {
+	if subprotocol == msgpackSubprotocol {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) messageType() int                           { return websocket.TextMessage }
+func (jsonCodec) marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec uses the json struct tags, so both encodings have the same field names
+type msgpackCodec struct{}
+
+func (msgpackCodec) messageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
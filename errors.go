@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes are sent with every error on websockets and HTTP
+// they're stable: clients can rely on them instead of messages
+const (
+	CodeTokenInvalid        = "TOKEN_INVALID"
+	CodeTokenExpired        = "TOKEN_EXPIRED"
+	CodeTokenRevoked        = "TOKEN_REVOKED"
+	CodeResumeFailed        = "RESUME_FAILED"
+	CodeSlowConsumer        = "SLOW_CONSUMER"
+	CodeRateLimited         = "RATE_LIMITED"
+	CodeInvalidCommand      = "INVALID_COMMAND"
+	CodeMessageTooLarge     = "MESSAGE_TOO_LARGE"
+	CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	CodeNotAllowed          = "NOT_ALLOWED" // the token doesn't have the capability
+	CodeForbidden           = "FORBIDDEN"   // the ACL doesn't allow the change
+	CodeNotFound            = "NOT_FOUND"
+	CodeAgentExists         = "AGENT_EXISTS"
+	CodeViewExists          = "VIEW_EXISTS"
+	CodePOIExists           = "POI_EXISTS"
+	CodeAirBeaconExists     = "AIRBEACON_EXISTS"
+	CodeTooManyViews        = "TOO_MANY_VIEWS"
+	CodeViewTooLarge        = "VIEW_TOO_LARGE"
+	CodeAirBeaconTooLarge   = "AIRBEACON_TOO_LARGE"
+	CodeRadiusTooLarge      = "RADIUS_TOO_LARGE"
+	CodeAgentTooFar         = "AGENT_TOO_FAR"
+	CodeOutsideRegion       = "OUTSIDE_REGION"
+	CodeInvalidCapabilities = "INVALID_CAPABILITIES"
+	CodeNotImplemented      = "NOT_IMPLEMENTED"
+	CodeInternal            = "INTERNAL_ERROR"
+)
+
+// GeeoError is an error with a code for clients, and the HTTP status it maps to
+type GeeoError struct {
+	Code    string
+	Message string
+	Status  int
+	Detail  string // optional, for humans
+}
+
+func newError(code string, status int, message string) *GeeoError {
+	return &GeeoError{Code: code, Message: message, Status: status}
+}
+
+func (e *GeeoError) Error() string {
+	return e.Message
+}
+
+// withDetail returns a copy of the error with details, sent as the message of the JSON error
+func (e *GeeoError) withDetail(detail string) *GeeoError {
+	copy := *e
+	copy.Detail = detail
+	return &copy
+}
+
+// asGeeoError returns err if it's a GeeoError, or an internal error
+func asGeeoError(err error) *GeeoError {
+	if gerr, ok := err.(*GeeoError); ok {
+		return gerr
+	}
+	return newError(CodeInternal, http.StatusInternalServerError, err.Error())
+}
+
+// invalidCommand turns a validation error into an INVALID_COMMAND error
+func invalidCommand(err error) *GeeoError {
+	return ErrInvalidCommand.withDetail(err.Error())
+}
+
+// toJSON returns the JSON error sent on websockets and HTTP
+func (e *GeeoError) toJSON() *JSONReply {
+	return &JSONReply{Error: e.Message, Code: e.Code, Message: e.Detail}
+}
+
+// writeHTTPError sends err with the HTTP status of its code
+func writeHTTPError(w http.ResponseWriter, route string, err error) {
+	gerr := asGeeoError(err)
+	w.WriteHeader(gerr.Status)
+	json.NewEncoder(w).Encode(gerr.toJSON())
+	if gerr.Detail != "" {
+		log.Warn(route, " HTTP route: ", gerr.Message, ", ", gerr.Detail)
+	} else {
+		log.Warn(route, " HTTP route: ", gerr.Message)
+	}
+}
@@ -7,6 +7,13 @@ type AgentMoveMessage struct {
 	JSONChangeMessage `json:"JSONChangeMessage,omitempty"`
 	ID                *string     `json:"agent_id"`
 	Point             *quad.Point `json:"pos,omitempty"`
+	ViewTags
+}
+
+func (m *AgentMoveMessage) taggedFor(views []string) JSONChangeMessage {
+	tagged := *m
+	tagged.Views = views
+	return &tagged
 }
 
 // Agent is the type of agents
@@ -7,10 +7,20 @@ type AirBeacon struct {
 	id         *string
 	publicData map[string]interface{}
 	creator    *string // the agent who created the AirBeacon, or null for a system AirBeacon
+	acl        *ACL
 	rect       *quad.Rect
+	shape      quad.Shape // the exact area of the AirBeacon, or nil if it's its rect
 	el         *quad.Element
 }
 
+// containsPoint tests the exact area of the AirBeacon
+func (ab *AirBeacon) containsPoint(p *quad.Point) bool {
+	if ab.shape == nil {
+		return true // we're only queried with points already inside our rect
+	}
+	return ab.shape.ContainsPoint(p)
+}
+
 // GetRect returns the position of the AB for quads
 func (ab *AirBeacon) GetRect() *quad.Rect {
 	return ab.rect
@@ -1,6 +1,10 @@
 package main
 
-import "geeo.io/GeeoServer/quad"
+import (
+	"time"
+
+	"geeo.io/GeeoServer/quad"
+)
 
 // POI is the type of points of interest
 type POI struct {
@@ -8,6 +12,8 @@ type POI struct {
 	id         *string
 	publicData map[string]interface{}
 	creator    *string // the agent who created the POI, or null for a system poi
+	acl        *ACL
+	expiresAt  *time.Time // nil if the POI never expires
 
 	point *quad.Point
 }
@@ -4,10 +4,12 @@ import "geeo.io/GeeoServer/quad"
 
 // View is the type of views
 type View struct {
-	id   *string
-	ws   *wsConn
-	rect *quad.Rect
-	el   *quad.Element
+	id     *string
+	name   string // the id of the view for its websocket client
+	ws     *wsConn
+	rect   *quad.Rect
+	el     *quad.Element
+	filter *ViewFilter // nil to receive all agents and POIs
 }
 
 // GetRect gets our position for quads
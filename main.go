@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,13 +35,14 @@ var (
 	WebHookHeaders map[string]string
 	// WebhookBearerToken is the bearer token passed to the webhook
 	WebhookBearerToken string
-	// SecretKey is used to check JWT tokens signatures
+	// SecretKey is used to check HS256 JWT tokens signatures, they're refused if it's empty
 	SecretKey string
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  2048,
 	WriteBufferSize: 4096,
+	Subprotocols:    Subprotocols,
 }
 
 var log = logrus.New()
@@ -97,6 +99,16 @@ func main() {
 	var ssl = flag.Bool("ssl", false, "Enable SSL support")
 	var sslhost = flag.String("sslhost", "", "FQDN for the SSL certificate")
 	var dev = flag.Bool("dev", false, "allow development routes")
+	var msgDistance = flag.Float64("msgdistance", 0, "max distance in meters between agents sending messages, 0 for no limit")
+	var pingInterval = flag.Duration("ping", PingInterval, "websocket ping interval, 0 to disable pings")
+	var pongWait = flag.Duration("pongwait", PongWait, "max wait for a pong before dropping a websocket")
+	var resumeGrace = flag.Duration("resumegrace", ResumeGracePeriod, "how long sessions can be resumed after their websocket is lost, 0 to disable")
+	var maxQueue = flag.Int("maxqueue", MaxQueuedMessages, "max number of messages waiting to be written to a websocket")
+	var overflow = flag.String("overflow", OverflowPolicy, "what to do when a client is too slow: coalesce, drop or disconnect")
+	var writeWait = flag.Duration("writewait", WriteWait, "max duration of a websocket write")
+	var rateLimits = flag.String("ratelimits", "", "JSON rate limits by command, eg. {\"agentPosition\":{\"rate\":20,\"burst\":40}}, overriding the defaults of the listed commands only")
+	var rateLimitHits = flag.Int("ratelimithits", MaxRateLimitHits, "commands over the rate limits within 10s before disconnecting a client, 0 to never disconnect")
+	var keys = flag.String("keys", "", "directory of PEM public keys named <kid>.pem, or JWKS file, to check RS256 and ES256 tokens")
 	flag.Parse()
 
 	var webhookwriter *WebhookWriter
@@ -126,6 +138,23 @@ func main() {
 		SecretKey = s
 	}
 
+	if k := os.Getenv("JWT_KEYS"); k != "" {
+		keys = &k
+	}
+	if *keys != "" {
+		if err := publicKeys.load(*keys); err != nil {
+			log.Error(err)
+			log.Fatal("Can't load JWT public keys")
+		}
+		go publicKeys.watch(KeysReloadInterval)
+
+		// the default secret is public, HS256 tokens need a secret set explicitly
+		if !isFlagSet("secret") && os.Getenv("SECRET") == "" {
+			SecretKey = ""
+			log.Info("HS256 JWT tokens are refused, set -secret or SECRET to accept them")
+		}
+	}
+
 	if hp := os.Getenv("HOST_PORT"); hp != "" {
 		hostPort = &hp
 	}
@@ -143,6 +172,91 @@ func main() {
 	if envDev := os.Getenv("DEV"); envDev != "" {
 		*dev = true
 	}
+	if envMsgDistance := os.Getenv("MESSAGE_MAX_DISTANCE"); envMsgDistance != "" {
+		d, err := strconv.ParseFloat(envMsgDistance, 64)
+		if err != nil {
+			log.Fatal("Can't parse MESSAGE_MAX_DISTANCE")
+		}
+		*msgDistance = d
+	}
+	MaxMessageDistance = *msgDistance
+
+	if envPing := os.Getenv("PING_INTERVAL"); envPing != "" {
+		d, err := time.ParseDuration(envPing)
+		if err != nil {
+			log.Fatal("Can't parse PING_INTERVAL")
+		}
+		*pingInterval = d
+	}
+	if envPongWait := os.Getenv("PONG_WAIT"); envPongWait != "" {
+		d, err := time.ParseDuration(envPongWait)
+		if err != nil {
+			log.Fatal("Can't parse PONG_WAIT")
+		}
+		*pongWait = d
+	}
+	if *pingInterval > 0 && *pongWait <= *pingInterval {
+		log.Fatal("pongwait must be larger than the ping interval")
+	}
+	PingInterval, PongWait = *pingInterval, *pongWait
+
+	if envResumeGrace := os.Getenv("RESUME_GRACE"); envResumeGrace != "" {
+		d, err := time.ParseDuration(envResumeGrace)
+		if err != nil {
+			log.Fatal("Can't parse RESUME_GRACE")
+		}
+		*resumeGrace = d
+	}
+	ResumeGracePeriod = *resumeGrace
+
+	if envMaxQueue := os.Getenv("MAX_QUEUE"); envMaxQueue != "" {
+		n, err := strconv.Atoi(envMaxQueue)
+		if err != nil {
+			log.Fatal("Can't parse MAX_QUEUE")
+		}
+		*maxQueue = n
+	}
+	if envOverflow := os.Getenv("OVERFLOW_POLICY"); envOverflow != "" {
+		*overflow = envOverflow
+	}
+	if envWriteWait := os.Getenv("WRITE_WAIT"); envWriteWait != "" {
+		d, err := time.ParseDuration(envWriteWait)
+		if err != nil {
+			log.Fatal("Can't parse WRITE_WAIT")
+		}
+		*writeWait = d
+	}
+	switch *overflow {
+	case OverflowCoalesce, OverflowDrop, OverflowDisconnect:
+	default:
+		log.Fatal("overflow must be coalesce, drop or disconnect")
+	}
+	if *maxQueue <= 0 || *writeWait <= 0 {
+		log.Fatal("maxqueue and writewait must be positive")
+	}
+	MaxQueuedMessages, OverflowPolicy, WriteWait = *maxQueue, *overflow, *writeWait
+
+	if envRateLimits := os.Getenv("RATE_LIMITS"); envRateLimits != "" {
+		*rateLimits = envRateLimits
+	}
+	if *rateLimits != "" {
+		limits := map[string]RateLimit{}
+		if err := json.Unmarshal([]byte(*rateLimits), &limits); err != nil {
+			log.Error(err)
+			log.Fatal("Can't JSON parse RATE_LIMITS")
+		}
+		for command, limit := range limits {
+			DefaultRateLimits[command] = limit
+		}
+	}
+	if envRateLimitHits := os.Getenv("RATE_LIMIT_HITS"); envRateLimitHits != "" {
+		n, err := strconv.Atoi(envRateLimitHits)
+		if err != nil {
+			log.Fatal("Can't parse RATE_LIMIT_HITS")
+		}
+		*rateLimitHits = n
+	}
+	MaxRateLimitHits = *rateLimitHits
 
 	if *cpuprofile != "" {
 		after2min := time.After(time.Minute * 2)
@@ -184,8 +298,12 @@ func main() {
 	defer persister.close()
 
 	geeodb := NewGeeoDB(persister, 5)
+	if err := persister.readRevocationsInto(revocations); err != nil {
+		log.Fatal("Can't load revocations: ", err)
+	}
 
 	wshandler := NewWSRouter(geeodb, webhookwriter)
+	go geeodb.reapExpiredPOIs(POIReapInterval, wshandler.handlePOIExpired)
 
 	r := mux.NewRouter()
 
@@ -204,7 +322,7 @@ func main() {
 	}
 
 	corsOptions := cors.Options{
-		AllowedMethods: []string{"GET", "POST", "DELETE"},
+		AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
 		AllowedHeaders: []string{"X-GEEO-TOKEN"},
 	}
 	if o := os.Getenv("ORIGIN"); o != "" {
@@ -255,3 +373,14 @@ func main() {
 	}
 	log.Fatal(srv.ListenAndServe())
 }
+
+// isFlagSet returns true if the flag was set on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -14,12 +14,19 @@ func DevHelperGetToken(w http.ResponseWriter, req *http.Request) {
 	viewID := req.URL.Query().Get("viewId")
 	agentID := req.URL.Query().Get("agId")
 
+	if SecretKey == "" {
+		http.Error(w, "HS256 tokens are refused without a secret", http.StatusForbidden)
+		return
+	}
+
 	caps := map[string]interface{}{
 		"produce":         true,
 		"consume":         true,
 		"createPOI":       true,
 		"createAirBeacon": true,
 		"sendEvents":      true,
+		"receiveEvents":   true,
+		"sendMessages":    true,
 		"maxView":         [2]float64{360, 180},
 		"maxAirBeacon":    [2]float64{360, 180},
 		"http":            true,
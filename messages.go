@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"time"
 
 	"geeo.io/GeeoServer/quad"
 )
@@ -11,58 +12,157 @@ type JSONChangeMessage interface{}
 
 // JSONCommand holds WS messages
 type JSONCommand struct {
+	ReqID           interface{}            `json:"reqId"` // echoed in replies, can be any JSON value
+	RefreshToken    *string                `json:"refreshToken"`
 	AgentPosition   *quad.Point            `json:"agentPosition"`
 	AgentPublicData map[string]interface{} `json:"publicData"`
 	ViewPosition    *quad.Rect             `json:"viewPosition"`
+	ViewFilter      *ViewFilter            `json:"viewFilter"`
+	AddView         *JSONView              `json:"addView"`
+	MoveView        *JSONView              `json:"moveView"`
+	RemoveView      *JSONView              `json:"removeView"`
 	CreatePOI       *JSONPOI               `json:"createPOI"`
+	UpdatePOI       *JSONPOI               `json:"updatePOI"`
 	RemovePOI       *JSONPOI               `json:"removePOI"`
 	CreateAirBeacon *JSONAirBeacon         `json:"createAirBeacon"`
 	RemoveAirBeacon *JSONAirBeacon         `json:"removeAirBeacon"`
-	// TODO add messages and geo events
-	//SendMessage        *JSONMessage           `json:"sendMessage"`
-	//SendEvent          *JSONEvent             `json:"sendMessage"`
+	Nearest         *JSONNearest           `json:"nearest"`
+	SendEvent       *JSONEvent             `json:"sendEvent"`
+	SendMessage     *JSONMessage           `json:"sendMessage"`
 }
 
 func (j *JSONCommand) check() error {
 
+	if j.RefreshToken != nil && *j.RefreshToken == "" {
+		return errors.New("Invalid refreshToken")
+	}
+
 	if j.AgentPosition != nil && !j.AgentPosition.IsValid() {
 		return errors.New("Invalid agentPosition")
 	}
-	if j.ViewPosition != nil {
-		// TODO we don't support wrapping around yet
-		if j.ViewPosition[0] >= j.ViewPosition[2] ||
-			j.ViewPosition[2] <= j.ViewPosition[0] {
-			j.ViewPosition[0] = -180
-			j.ViewPosition[2] = 180
+	// views with x1 > x2 wrap around the antimeridian
+	if j.ViewPosition != nil && !j.ViewPosition.IsValid() {
+		return errors.New("Invalid viewPosition")
+	}
+	if j.ViewFilter != nil {
+		if err := j.ViewFilter.check(); err != nil {
+			return err
 		}
-		if !j.ViewPosition.IsValid() {
-			return errors.New("Invalid viewPosition")
+	}
+	if j.AddView != nil && (j.AddView.ID == nil || j.AddView.Pos == nil || !j.AddView.Pos.IsValid()) {
+		return errors.New("Invalid view")
+	}
+	// moveView can change the position and/or the filter of a view
+	if j.MoveView != nil && (j.MoveView.ID == nil || (j.MoveView.Pos == nil && j.MoveView.Filter == nil) || (j.MoveView.Pos != nil && !j.MoveView.Pos.IsValid())) {
+		return errors.New("Invalid view")
+	}
+	for _, view := range []*JSONView{j.AddView, j.MoveView} {
+		if view != nil && view.Filter != nil {
+			if err := view.Filter.check(); err != nil {
+				return err
+			}
 		}
 	}
+	if j.RemoveView != nil && j.RemoveView.ID == nil {
+		return errors.New("Invalid view ID")
+	}
 
-	if j.CreatePOI != nil && !j.CreatePOI.Pos.IsValid() {
-		return errors.New("Invalid POI position")
+	if j.CreatePOI != nil {
+		if err := j.CreatePOI.check(); err != nil {
+			return err
+		}
+	}
+	if j.UpdatePOI != nil {
+		if err := j.UpdatePOI.checkUpdate(); err != nil {
+			return err
+		}
 	}
 	if j.RemovePOI != nil && j.RemovePOI.ID == nil {
 		return errors.New("Invalid POI ID")
 	}
-	if j.CreateAirBeacon != nil && !j.CreateAirBeacon.Pos.IsValid() {
-		return errors.New("Invalid AirBeacon position")
+	if j.CreateAirBeacon != nil {
+		if err := j.CreateAirBeacon.check(); err != nil {
+			return err
+		}
 	}
 	if j.RemoveAirBeacon != nil && j.RemoveAirBeacon.ID == nil {
 		return errors.New("Invalid air beacon ID")
 	}
+	if j.SendEvent != nil {
+		if err := j.SendEvent.check(); err != nil {
+			return err
+		}
+	}
+	if j.SendMessage != nil && j.SendMessage.To == nil {
+		return errors.New("Invalid message recipient")
+	}
+	if j.Nearest != nil {
+		if j.Nearest.Pos == nil || !j.Nearest.Pos.IsValid() {
+			return errors.New("Invalid nearest position")
+		}
+		if j.Nearest.K <= 0 || j.Nearest.K > MaxNearestResults {
+			return errors.New("Invalid nearest count")
+		}
+		if j.Nearest.Type != "" && j.Nearest.Type != "agent" && j.Nearest.Type != "poi" {
+			return errors.New("Invalid nearest type")
+		}
+	}
 	return nil
 }
 
 func (j *JSONCommand) clear() {
+	j.ReqID = nil
+	j.RefreshToken = nil
 	j.AgentPosition = nil
 	j.AgentPublicData = nil
 	j.ViewPosition = nil
+	j.ViewFilter = nil
+	j.AddView = nil
+	j.MoveView = nil
+	j.RemoveView = nil
 	j.CreatePOI = nil
+	j.UpdatePOI = nil
 	j.RemovePOI = nil
 	j.CreateAirBeacon = nil
 	j.RemoveAirBeacon = nil
+	j.Nearest = nil
+	j.SendEvent = nil
+	j.SendMessage = nil
+}
+
+// JSONReply acknowledges a part of a command, or reports its error
+type JSONReply struct {
+	ReqID   interface{} `json:"reqId,omitempty"`
+	Command string      `json:"command,omitempty"`
+	OK      bool        `json:"ok,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+// JSONView holds named view messages
+type JSONView struct {
+	ID     *string     `json:"view_id"`
+	Pos    *quad.Rect  `json:"pos,omitempty"`
+	Filter *ViewFilter `json:"filter,omitempty"`
+}
+
+// ViewTags lists the views of a websocket a message is sent to
+type ViewTags struct {
+	Views []string `json:"views,omitempty"`
+}
+
+// viewTaggable messages can be copied and tagged with the views they're sent to
+type viewTaggable interface {
+	taggedFor(views []string) JSONChangeMessage
+}
+
+// tagMessage returns a copy of message tagged with views if it can be tagged
+func tagMessage(message JSONChangeMessage, views []string) JSONChangeMessage {
+	if taggable, ok := message.(viewTaggable); ok {
+		return taggable.taggedFor(views)
+	}
+	return message
 }
 
 // EnteredLeft is used to provide additional enter/leave information
@@ -76,12 +176,59 @@ func (e *EnteredLeft) clearEnteredLeft() {
 	e.Left = false
 }
 
+// maxPOITTL is the longest ttl of a POI, it keeps the expiry within time.Duration
+const maxPOITTL = 100 * 365 * 24 * time.Hour
+
 // JSONPOI holds POI messages
 type JSONPOI struct {
 	ID         *string                `json:"poi_id"`
 	Pos        *quad.Point            `json:"pos,omitempty"`
 	PublicData map[string]interface{} `json:"publicData,omitempty"`
 	Creator    *string                `json:"creator,omitempty"`
+	ACL        *ACL                   `json:"acl,omitempty"` // never sent to views
+	TTL        *float64               `json:"ttl,omitempty"` // in seconds
+	ExpiresAt  *time.Time             `json:"expiresAt,omitempty"`
+}
+
+// check validates a POI creation
+func (p *JSONPOI) check() error {
+	if p.ID == nil || p.Pos == nil || !p.Pos.IsValid() {
+		return errors.New("Invalid POI position")
+	}
+	return p.checkExpiry()
+}
+
+// checkUpdate validates a POI update: pos, publicData and expiry are all optional
+func (p *JSONPOI) checkUpdate() error {
+	if p.ID == nil {
+		return errors.New("Invalid POI ID")
+	}
+	if p.Pos != nil && !p.Pos.IsValid() {
+		return errors.New("Invalid POI position")
+	}
+	return p.checkExpiry()
+}
+
+func (p *JSONPOI) checkExpiry() error {
+	if p.TTL != nil && p.ExpiresAt != nil {
+		return errors.New("Invalid POI expiry: use either ttl or expiresAt")
+	}
+	if p.TTL != nil && (*p.TTL <= 0 || *p.TTL > maxPOITTL.Seconds()) {
+		return errors.New("Invalid POI ttl")
+	}
+	if p.ExpiresAt != nil && !p.ExpiresAt.After(time.Now()) {
+		return errors.New("Invalid POI expiresAt: it's in the past")
+	}
+	return nil
+}
+
+// expiry returns when the POI expires, or nil if it doesn't
+func (p *JSONPOI) expiry() *time.Time {
+	if p.TTL != nil {
+		expiresAt := time.Now().Add(time.Duration(*p.TTL * float64(time.Second)))
+		return &expiresAt
+	}
+	return p.ExpiresAt
 }
 
 func (p *JSONPOI) clear() {
@@ -89,14 +236,120 @@ func (p *JSONPOI) clear() {
 	p.Pos = nil
 	p.PublicData = nil
 	p.Creator = nil
+	p.ACL = nil
+	p.TTL = nil
+	p.ExpiresAt = nil
+}
+
+// acl returns the ACL of a new POI: the one in the message, or the default one
+func (p *JSONPOI) acl(creator *string) *ACL {
+	if p.ACL != nil {
+		return p.ACL
+	}
+	return newACL(creator)
 }
 
 // JSONAirBeacon holds AirBeacon messages
+// An AirBeacon is either a rect (pos), a polygon or a circle, whose pos is then their bounding box
 type JSONAirBeacon struct {
 	ID         *string                `json:"ab_id"`
 	Pos        *quad.Rect             `json:"pos,omitempty"`
+	Polygon    quad.Polygon           `json:"polygon,omitempty"`
+	Circle     *quad.Circle           `json:"circle,omitempty"`
 	PublicData map[string]interface{} `json:"publicData,omitempty"`
 	Creator    *string                `json:"creator,omitempty"`
+	ACL        *ACL                   `json:"acl,omitempty"`
+}
+
+// acl returns the ACL of a new AirBeacon: the one in the message, or the default one
+func (ab *JSONAirBeacon) acl(creator *string) *ACL {
+	if ab.ACL != nil {
+		return ab.ACL
+	}
+	return newACL(creator)
+}
+
+// check validates an AirBeacon creation, and sets its pos from its shape
+func (ab *JSONAirBeacon) check() error {
+	if ab.ID == nil {
+		return errors.New("Invalid AirBeacon ID")
+	}
+	if ab.Polygon != nil {
+		if !ab.Polygon.IsValid() {
+			return errors.New("Invalid AirBeacon polygon")
+		}
+		rect := ab.Polygon.BoundingRect()
+		ab.Pos = &rect
+	}
+	if ab.Circle != nil {
+		if ab.Polygon != nil {
+			return errors.New("AirBeacon can't be both a polygon and a circle")
+		}
+		if !ab.Circle.IsValid() {
+			return errors.New("Invalid AirBeacon circle")
+		}
+		rect := ab.Circle.BoundingRect()
+		ab.Pos = &rect
+	}
+	if ab.Pos == nil || !ab.Pos.IsValid() {
+		return errors.New("Invalid AirBeacon position")
+	}
+	return nil
+}
+
+// shape returns the exact area of the AirBeacon, or nil if it's a rect
+func (ab *JSONAirBeacon) shape() quad.Shape {
+	if ab.Polygon != nil {
+		return ab.Polygon
+	}
+	if ab.Circle != nil {
+		return *ab.Circle
+	}
+	return nil
+}
+
+// JSONNearest holds k-nearest-neighbour search requests
+type JSONNearest struct {
+	Pos  *quad.Point `json:"pos"`
+	K    int         `json:"k"`
+	Type string      `json:"type,omitempty"` // "agent", "poi" or empty for both
+}
+
+// JSONEvent holds location events
+type JSONEvent struct {
+	Pos     *quad.Point `json:"pos"`
+	Radius  float64     `json:"radius"` // in meters
+	Payload interface{} `json:"payload,omitempty"`
+	From    *string     `json:"from,omitempty"` // the agent who sent the event, or null for a system event
+}
+
+func (e *JSONEvent) check() error {
+	if e.Pos == nil || !e.Pos.IsValid() {
+		return errors.New("Invalid event position")
+	}
+	if e.Radius < 0 {
+		return errors.New("Invalid event radius")
+	}
+	return nil
+}
+
+// JSONEventMessage is sent through the WS when an event happens near an agent or in a view
+type JSONEventMessage struct {
+	JSONChangeMessage `json:"JSONChangeMessage,omitempty"`
+	Event             *JSONEvent `json:"event"`
+}
+
+// JSONMessage holds direct messages between agents
+type JSONMessage struct {
+	To      *string     `json:"to,omitempty"`
+	From    *string     `json:"from,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// JSONDirectMessage is sent through the WS when an agent receives a message
+type JSONDirectMessage struct {
+	JSONChangeMessage `json:"JSONChangeMessage,omitempty"`
+	Message           *JSONMessage `json:"message"`
 }
 
 // JSONAgent describes the public view on agents
@@ -112,11 +365,29 @@ func (a *JSONAgent) clear() {
 	a.PublicData = nil
 }
 
+// pointLikeToJSON returns the public JSON description of an Agent or a POI
+func pointLikeToJSON(each interface{}) interface{} {
+	switch pointLike := each.(type) {
+	case *Agent:
+		return &JSONAgent{ID: pointLike.ID, Pos: pointLike.GetPoint(), PublicData: pointLike.publicData}
+	case *POI:
+		return &JSONPOI{ID: pointLike.id, Pos: pointLike.GetPoint(), PublicData: pointLike.publicData, Creator: pointLike.creator}
+	}
+	return nil
+}
+
 // JSONPOIEnteredLeft holds POI enter/leave messages
 type JSONPOIEnteredLeft struct {
 	JSONChangeMessage `json:"JSONChangeMessage,omitempty"`
 	JSONPOI
 	EnteredLeft
+	ViewTags
+}
+
+func (m *JSONPOIEnteredLeft) taggedFor(views []string) JSONChangeMessage {
+	tagged := *m
+	tagged.Views = views
+	return &tagged
 }
 
 func (poi *POI) enterLeaveMessage(enter bool) JSONChangeMessage {
@@ -126,6 +397,7 @@ func (poi *POI) enterLeaveMessage(enter bool) JSONChangeMessage {
 		message.Pos = poi.GetPoint()
 		message.PublicData = poi.publicData
 		message.Creator = poi.creator
+		message.ExpiresAt = poi.expiresAt
 		message.Entered = true
 	} else {
 		message.Left = true
@@ -134,11 +406,30 @@ func (poi *POI) enterLeaveMessage(enter bool) JSONChangeMessage {
 	return message
 }
 
+// updateMessage is sent to views which see the POI before and after a change
+func (poi *POI) updateMessage() JSONChangeMessage {
+	message := &JSONPOIEnteredLeft{} // neither entered nor left: an update
+	message.ID = poi.id
+	message.Pos = poi.GetPoint()
+	message.PublicData = poi.publicData
+	message.Creator = poi.creator
+	message.ExpiresAt = poi.expiresAt
+
+	return message
+}
+
 // JSONAgentEnteredLeft is sent through the WS when an agent enters/leaves a view
 type JSONAgentEnteredLeft struct {
 	JSONChangeMessage `json:"JSONChangeMessage,omitempty"`
 	JSONAgent
 	EnteredLeft
+	ViewTags
+}
+
+func (m *JSONAgentEnteredLeft) taggedFor(views []string) JSONChangeMessage {
+	tagged := *m
+	tagged.Views = views
+	return &tagged
 }
 
 func (a *Agent) enterLeaveMessage(enter bool) JSONChangeMessage {
@@ -12,8 +12,9 @@ import (
 )
 
 var (
-	poisBucket       = []byte("pois")
-	airBeaconsBucket = []byte("airBeacons")
+	poisBucket        = []byte("pois")
+	airBeaconsBucket  = []byte("airBeacons")
+	revocationsBucket = []byte("revocations")
 )
 
 type boltDBPersister struct {
@@ -21,18 +22,23 @@ type boltDBPersister struct {
 }
 
 // We already have a JSON struct for POIs, for sending over websockets
-// but in the future, we'll add ACLs for instance, which must be saved, but not sent over WS
+// but ACLs for instance must be saved, but not sent over WS
 type serializedPOI struct {
 	ID         *string
 	Pos        *quad.Point
 	PublicData map[string]interface{}
 	Creator    *string
+	ACL        *ACL
+	ExpiresAt  *time.Time `json:",omitempty"`
 }
 type serializedAirBeacon struct {
 	ID         *string
 	Pos        *quad.Rect
+	Polygon    quad.Polygon
+	Circle     *quad.Circle
 	PublicData map[string]interface{}
 	Creator    *string
+	ACL        *ACL
 }
 
 // TODO replace CreateBucketIfNotExists with the simpler Bucket where appropriate
@@ -54,6 +60,10 @@ func newBoltDBPersister(dbfilename string) Persister {
 		if errABs != nil {
 			return errABs
 		}
+		_, errRevocations := tx.CreateBucketIfNotExists(revocationsBucket)
+		if errRevocations != nil {
+			return errRevocations
+		}
 		return nil
 	})
 	if err != nil {
@@ -81,7 +91,17 @@ func (p *boltDBPersister) readAirBeaconsInto(geeodb *GeeoDB) error {
 				obj := serializedAirBeacon{}
 				json.Unmarshal(v, &obj)
 				rect := quad.NewRect(obj.Pos[0], obj.Pos[1], obj.Pos[2], obj.Pos[3])
-				geeodb._loadAirBeacon(*obj.ID, &rect, obj.PublicData, obj.Creator)
+				var shape quad.Shape
+				if obj.Polygon != nil {
+					shape = obj.Polygon
+				}
+				if obj.Circle != nil {
+					shape = *obj.Circle
+				}
+				if obj.ACL == nil { // saved before ACLs
+					obj.ACL = newACL(obj.Creator)
+				}
+				geeodb._loadAirBeacon(*obj.ID, &rect, shape, obj.PublicData, obj.Creator, obj.ACL)
 			}
 		}()
 
@@ -100,16 +120,22 @@ func (p *boltDBPersister) readAirBeaconsInto(geeodb *GeeoDB) error {
 
 func (p *boltDBPersister) readPOIsInto(geeodb *GeeoDB) error {
 	log.Info("Loading POIs from file")
-	return p.db.View(func(tx *bolt.Tx) error {
+
+	// POIs which expired while we were down are skipped, and deleted once they're all read
+	var expired []string
+
+	err := p.db.View(func(tx *bolt.Tx) error {
 
 		bucket := tx.Bucket(poisBucket)
 		before := time.Now()
 		counter := 0
 
 		parseChannel := make(chan []byte)
+		done := make(chan struct{})
 		// start a goroutine just for adding to rtree
 		go func() {
 			defer func() { log.Debug("Persister done inserting POIs to RTree") }()
+			defer close(done)
 			for {
 				select {
 				case v, more := <-parseChannel:
@@ -118,8 +144,15 @@ func (p *boltDBPersister) readPOIsInto(geeodb *GeeoDB) error {
 					}
 					obj := serializedPOI{}
 					json.Unmarshal(v, &obj)
+					if obj.ExpiresAt != nil && !obj.ExpiresAt.After(before) {
+						expired = append(expired, *obj.ID)
+						continue
+					}
 					point := quad.NewPoint(obj.Pos[0], obj.Pos[1])
-					geeodb._loadPOI(*obj.ID, &point, obj.PublicData, obj.Creator)
+					if obj.ACL == nil { // saved before ACLs
+						obj.ACL = newACL(obj.Creator)
+					}
+					geeodb._loadPOI(*obj.ID, &point, obj.PublicData, obj.Creator, obj.ACL, obj.ExpiresAt)
 				}
 			}
 		}()
@@ -130,16 +163,30 @@ func (p *boltDBPersister) readPOIsInto(geeodb *GeeoDB) error {
 			return nil
 		})
 		close(parseChannel)
+		<-done
 		after := time.Now()
 
-		log.Infof("BoltDB: loaded %d points of interest in %fs", counter, after.Sub(before).Seconds())
+		log.Infof("BoltDB: loaded %d points of interest in %fs (%d expired)", counter-len(expired), after.Sub(before).Seconds(), len(expired))
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(poisBucket)
+		for _, id := range expired {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 func (p *boltDBPersister) persistPOI(poi *POI) error {
 
 	// we're using JSON marshalling: it will be easier to upgrade to a new version of JSON schemas
-	obj := serializedPOI{poi.id, poi.GetPoint(), poi.publicData, poi.creator}
+	obj := serializedPOI{poi.id, poi.GetPoint(), poi.publicData, poi.creator, poi.acl, poi.expiresAt}
 
 	bytes, err := json.Marshal(obj)
 	if err != nil {
@@ -169,7 +216,13 @@ func (p *boltDBPersister) removePOI(poi *POI) error {
 func (p *boltDBPersister) persistAirBeacon(ab *AirBeacon) error {
 
 	// we're using JSON marshalling: it will be easier to upgrade to a new version of JSON schemas
-	obj := serializedAirBeacon{ab.id, ab.GetRect(), ab.publicData, ab.creator}
+	obj := serializedAirBeacon{ID: ab.id, Pos: ab.GetRect(), PublicData: ab.publicData, Creator: ab.creator, ACL: ab.acl}
+	switch shape := ab.shape.(type) {
+	case quad.Polygon:
+		obj.Polygon = shape
+	case quad.Circle:
+		obj.Circle = &shape
+	}
 
 	bytes, err := json.Marshal(obj)
 	if err != nil {
@@ -196,6 +249,52 @@ func (p *boltDBPersister) removeAirBeacon(ab *AirBeacon) error {
 	})
 }
 
+func (p *boltDBPersister) readRevocationsInto(revocations *revocationList) error {
+	log.Info("Loading revocations from file")
+	return p.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(revocationsBucket)
+		counter := 0
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			r := &Revocation{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			revocations.add(r)
+			counter++
+			return nil
+		})
+		log.Infof("Loaded %d revocations", counter)
+		return err
+	})
+}
+
+func (p *boltDBPersister) persistRevocation(r *Revocation) error {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(revocationsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(r.key()), bytes)
+	})
+}
+func (p *boltDBPersister) removeRevocation(r *Revocation) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(revocationsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Delete([]byte(r.key()))
+	})
+}
+
 func (p *boltDBPersister) close() {
 	p.db.Close()
 }
@@ -27,6 +27,16 @@ func (p *nullPersister) removeAirBeacon(ab *AirBeacon) error {
 	return nil
 }
 
+func (p *nullPersister) readRevocationsInto(revocations *revocationList) error {
+	return nil
+}
+func (p *nullPersister) persistRevocation(r *Revocation) error {
+	return nil
+}
+func (p *nullPersister) removeRevocation(r *Revocation) error {
+	return nil
+}
+
 func (p *nullPersister) close() {}
 
 func (p *nullPersister) BackupHandleFunc(w http.ResponseWriter, req *http.Request) {
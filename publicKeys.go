@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// KeysReloadInterval determines how often the public keys are checked for changes
+var KeysReloadInterval = 10 * time.Second
+
+// publicKeys holds the keys checking RS256 and ES256 signatures
+var publicKeys = &keyStore{keys: map[string]interface{}{}}
+
+// keyStore holds RSA and ECDSA public keys, by kid
+// they're loaded from a directory of PEM files named after their kid, or from a JWKS file
+// several keys can be valid at once, so that tokens signed with the previous key are still accepted during a rotation
+type keyStore struct {
+	sync.RWMutex
+	keys    map[string]interface{} // *rsa.PublicKey or *ecdsa.PublicKey
+	path    string
+	version string // names and modification times of the files, to detect changes
+}
+
+// get returns the key for kid, if it can check signatures of method
+func (ks *keyStore) get(kid string, method jwt.SigningMethod) (interface{}, error) {
+	ks.RLock()
+	key, found := ks.keys[kid]
+	ks.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("Unknown key: %s", kid)
+	}
+
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Key %s can't check %s signatures", kid, method.Alg())
+}
+
+// load reads the keys of path, a directory of PEM files or a JWKS file
+func (ks *keyStore) load(path string) error {
+	version, err := fileVersion(path)
+	if err != nil {
+		return err
+	}
+	var keys map[string]interface{}
+	if info, _ := os.Stat(path); info.IsDir() {
+		keys, err = readPEMDirectory(path)
+	} else {
+		keys, err = readJWKSFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	ks.Lock()
+	ks.keys, ks.path, ks.version = keys, path, version
+	ks.Unlock()
+
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	log.Info("Loaded JWT public keys from ", path, ": ", strings.Join(kids, ", "))
+	return nil
+}
+
+// watch reloads the keys when their files change, it never returns
+// the previous keys are kept if the new ones can't be read
+func (ks *keyStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		ks.RLock()
+		path, previous := ks.path, ks.version
+		ks.RUnlock()
+
+		version, err := fileVersion(path)
+		if err != nil {
+			log.Error("Can't check JWT public keys: ", err)
+			continue
+		}
+		if version == previous {
+			continue
+		}
+		if err := ks.load(path); err != nil {
+			log.Error("Can't reload JWT public keys, keeping the previous ones: ", err)
+		}
+	}
+}
+
+// fileVersion returns the names and modification times of path, or of the files of a directory
+func fileVersion(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fmt.Sprint(info.ModTime().UnixNano(), info.Size()), nil
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	var version strings.Builder
+	for _, file := range files {
+		fmt.Fprint(&version, file.Name(), file.ModTime().UnixNano(), file.Size(), ";")
+	}
+	return version.String(), nil
+}
+
+// readPEMDirectory reads the *.pem files of dir, each named after the kid of its key
+func readPEMDirectory(dir string) (map[string]interface{}, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+			keys[kid] = key
+		} else if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+			keys[kid] = key
+		} else {
+			return nil, fmt.Errorf("%s isn't an RSA or ECDSA public key", file)
+		}
+	}
+	return keys, nil
+}
+
+// jsonWebKey is a RSA or EC public key of a JWKS file
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"` // RSA
+	E   string `json:"e"`
+	Crv string `json:"crv"` // EC
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// readJWKSFile reads the signature keys of a JWKS file, other keys are ignored
+func readJWKSFile(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if jwk.Kid == "" {
+			return nil, errors.New("JWKS keys must have a kid")
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", jwk.Kid, err.Error())
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the RSA or ECDSA key, or nil for other types of keys
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := decodeBigInt(jwk.N)
+		e, errE := decodeBigInt(jwk.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, errX := decodeBigInt(jwk.X)
+		y, errY := decodeBigInt(jwk.Y)
+		if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func testKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey, ecKey
+}
+
+func TestJSONWebKey(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	n, e := encodeBigInt(rsaKey.N), encodeBigInt(big.NewInt(int64(rsaKey.E)))
+	x, y := encodeBigInt(ecKey.X), encodeBigInt(ecKey.Y)
+
+	tests := []struct {
+		name     string
+		jwk      jsonWebKey
+		expected interface{} // nil if the key is ignored
+		invalid  bool
+	}{
+		{"RSA", jsonWebKey{Kty: "RSA", N: n, E: e}, &rsaKey.PublicKey, false},
+		{"RSA with padding", jsonWebKey{Kty: "RSA", N: n, E: "AQAB=="}, &rsaKey.PublicKey, false},
+		{"RSA without modulus", jsonWebKey{Kty: "RSA", N: "!!", E: e}, nil, true},
+		{"RSA with a large exponent", jsonWebKey{Kty: "RSA", N: n, E: encodeBigInt(new(big.Int).Lsh(big.NewInt(1), 80))}, nil, true},
+		{"EC", jsonWebKey{Kty: "EC", Crv: "P-256", X: x, Y: y}, &ecKey.PublicKey, false},
+		{"EC on another curve", jsonWebKey{Kty: "EC", Crv: "P-384", X: x, Y: y}, nil, true},
+		{"EC with an unsupported curve", jsonWebKey{Kty: "EC", Crv: "secp256k1", X: x, Y: y}, nil, true},
+		{"EC off the curve", jsonWebKey{Kty: "EC", Crv: "P-256", X: x, Y: x}, nil, true},
+		{"symmetric", jsonWebKey{Kty: "oct"}, nil, false},
+	}
+	for _, test := range tests {
+		key, err := test.jwk.publicKey()
+		if (err != nil) != test.invalid {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		switch expected := test.expected.(type) {
+		case nil:
+			if key != nil {
+				t.Errorf("%s: got a key", test.name)
+			}
+		case *rsa.PublicKey:
+			if k, ok := key.(*rsa.PublicKey); !ok || k.N.Cmp(expected.N) != 0 || k.E != expected.E {
+				t.Errorf("%s: got %v", test.name, key)
+			}
+		case *ecdsa.PublicKey:
+			if k, ok := key.(*ecdsa.PublicKey); !ok || k.Curve != expected.Curve || k.X.Cmp(expected.X) != 0 || k.Y.Cmp(expected.Y) != 0 {
+				t.Errorf("%s: got %v", test.name, key)
+			}
+		}
+	}
+}
+
+func TestReadJWKSFile(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	n, e := encodeBigInt(rsaKey.N), encodeBigInt(big.NewInt(int64(rsaKey.E)))
+	x, y := encodeBigInt(ecKey.X), encodeBigInt(ecKey.Y)
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		jwks    string
+		kids    []string
+		invalid bool
+	}{
+		{"RSA and EC keys",
+			`{"keys": [{"kty": "RSA", "kid": "r", "n": "` + n + `", "e": "` + e + `"}, {"kty": "EC", "kid": "e", "use": "sig", "crv": "P-256", "x": "` + x + `", "y": "` + y + `"}]}`,
+			[]string{"r", "e"}, false},
+		{"encryption keys are skipped",
+			`{"keys": [{"kty": "RSA", "kid": "r", "use": "enc", "n": "` + n + `", "e": "` + e + `"}, {"kty": "EC", "kid": "e", "crv": "P-256", "x": "` + x + `", "y": "` + y + `"}]}`,
+			[]string{"e"}, false},
+		{"invalid encryption keys are skipped",
+			`{"keys": [{"kty": "EC", "use": "enc", "crv": "P-999"}]}`,
+			nil, false},
+		{"other types of keys are skipped",
+			`{"keys": [{"kty": "oct", "kid": "s", "k": "c2VjcmV0"}]}`,
+			nil, false},
+		{"keys need a kid",
+			`{"keys": [{"kty": "RSA", "n": "` + n + `", "e": "` + e + `"}]}`,
+			nil, true},
+		{"invalid keys",
+			`{"keys": [{"kty": "EC", "kid": "e", "crv": "P-256", "x": "` + x + `", "y": "` + x + `"}]}`,
+			nil, true},
+		{"invalid JSON", `{"keys": [`, nil, true},
+	}
+	for i, test := range tests {
+		file := filepath.Join(dir, "jwks"+string(rune('a'+i))+".json")
+		if err := ioutil.WriteFile(file, []byte(test.jwks), 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := readJWKSFile(file)
+		if (err != nil) != test.invalid {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if len(keys) != len(test.kids) {
+			t.Errorf("%s: got %d keys, expected %v", test.name, len(keys), test.kids)
+		}
+		for _, kid := range test.kids {
+			if keys[kid] == nil {
+				t.Errorf("%s: missing key %s", test.name, kid)
+			}
+		}
+	}
+
+	if _, err := readJWKSFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("a missing file can be read")
+	}
+}
+
+func TestKeyStoreGet(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	ks := &keyStore{keys: map[string]interface{}{"r": &rsaKey.PublicKey, "e": &ecKey.PublicKey}}
+
+	tests := []struct {
+		kid    string
+		method jwt.SigningMethod
+		found  bool
+	}{
+		{"r", jwt.SigningMethodRS256, true},
+		{"r", jwt.SigningMethodPS256, true},
+		{"r", jwt.SigningMethodES256, false},
+		{"e", jwt.SigningMethodES256, true},
+		{"e", jwt.SigningMethodRS256, false},
+		{"e", jwt.SigningMethodHS256, false},
+		{"unknown", jwt.SigningMethodRS256, false},
+		{"", jwt.SigningMethodRS256, false},
+	}
+	for _, test := range tests {
+		key, err := ks.get(test.kid, test.method)
+		if (err == nil) != test.found || (key != nil) != test.found {
+			t.Errorf("%s with %s: got %v, %v", test.kid, test.method.Alg(), key, err)
+		}
+	}
+}
+
+func TestParseJWTTokenAlgorithms(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	previousKeys, previousSecret := publicKeys, SecretKey
+	defer func() { publicKeys, SecretKey = previousKeys, previousSecret }()
+	publicKeys = &keyStore{keys: map[string]interface{}{"r": &rsaKey.PublicKey, "e": &ecKey.PublicKey}}
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"agentId": "a", "viewId": "v", "caps": map[string]interface{}{"produce": true}})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		valid  bool
+	}{
+		{"RS256", "", sign(jwt.SigningMethodRS256, "r", rsaKey), true},
+		{"ES256", "", sign(jwt.SigningMethodES256, "e", ecKey), true},
+		{"RS256 with the EC kid", "", sign(jwt.SigningMethodRS256, "e", rsaKey), false},
+		{"RS256 without kid", "", sign(jwt.SigningMethodRS256, "", rsaKey), false},
+		{"HS256 without secret", "", sign(jwt.SigningMethodHS256, "", []byte("")), false},
+		{"HS256 with the default secret", "", sign(jwt.SigningMethodHS256, "", []byte("developmentKey")), false},
+		{"HS256 with a secret", "s3cret", sign(jwt.SigningMethodHS256, "", []byte("s3cret")), true},
+	}
+	for _, test := range tests {
+		SecretKey = test.secret
+		token, err := parseJWTToken(test.token)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if test.valid && (token.AgentID != "a" || !token.Capabilities.Produce) {
+			t.Errorf("%s: got %v", test.name, token)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package quad
 
 import (
 	"errors"
+	"math"
 
 	"log"
 )
 
+// EarthRadius is the mean radius of the earth, in meters
+const EarthRadius = 6371008.8
+
 // Point models a point x/y or Lon/Lat ([-180, 180], [-90, 90])
 type Point [2]float64
 
@@ -14,21 +18,112 @@ func (p *Point) IsValid() bool {
 		p[1] >= -90 && p[1] <= 90
 }
 
+// DistanceTo returns the great-circle distance in meters between two points
+func (p *Point) DistanceTo(o *Point) float64 {
+	return haversine(p[0], p[1], o[0], o[1])
+}
+
+// MetersToDegrees converts a distance along a meridian to degrees of latitude
+func MetersToDegrees(meters float64) float64 {
+	return toDegrees(meters / EarthRadius)
+}
+
+// DegreesToMeters converts degrees of latitude to a distance along a meridian
+func DegreesToMeters(degrees float64) float64 {
+	return toRadians(degrees) * EarthRadius
+}
+
+func haversine(lon1, lat1, lon2, lat2 float64) float64 {
+	φ1, φ2 := toRadians(lat1), toRadians(lat2)
+	dφ := toRadians(lat2 - lat1)
+	dλ := toRadians(lon2 - lon1)
+	a := math.Sin(dφ/2)*math.Sin(dφ/2) + math.Cos(φ1)*math.Cos(φ2)*math.Sin(dλ/2)*math.Sin(dλ/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+func toRadians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+func toDegrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
 // Rect models a rect (x1,y1, x2,y2)
-// TODO LATER points where x1 < x2 should wrap around the world instead of being an error
+// Rects where x1 > x2 wrap around the world, crossing the antimeridian
 type Rect [4]float64
 
 func (r *Rect) IsValid() bool {
 	return r[0] >= -180 && r[0] <= 180 &&
 		r[2] >= -180 && r[2] <= 180 &&
 		r[1] >= -90 && r[1] <= 90 &&
-		r[3] >= -90 && r[3] <= 90
+		r[3] >= -90 && r[3] <= 90 &&
+		r[1] <= r[3]
+}
+
+func (r *Rect) wraps() bool {
+	return r[0] > r[2]
+}
+
+// splitAntimeridian returns the two halves of a wrapping rect, east of x1 and west of x2
+func (r *Rect) splitAntimeridian() [2]Rect {
+	return [2]Rect{
+		{r.x1(), r.y1(), 180, r.y2()},
+		{-180, r.y1(), r.x2(), r.y2()},
+	}
+}
+
+// Contains returns true if p is in the rect, borders included
+func (r *Rect) Contains(p *Point) bool {
+	return r.contains(p)
+}
+
+// ContainsRect returns true if o is entirely in the rect
+func (r *Rect) ContainsRect(o *Rect) bool {
+	return r.containsRect(o)
 }
 
 func (r *Rect) contains(p *Point) bool {
-	return r[0] <= p[0] && r[1] <= p[1] && r[2] >= p[0] && r[3] >= p[1]
+	return r.containsLon(p[0]) && r[1] <= p[1] && r[3] >= p[1]
+}
+func (r *Rect) containsLon(lon float64) bool {
+	if r.wraps() {
+		return r[0] <= lon || r[2] >= lon
+	}
+	return r[0] <= lon && r[2] >= lon
 }
+
+// minDistance returns the shortest great-circle distance in meters between a point and the rect
+// it never overestimates, so it can be used to prune subtrees
+func (r *Rect) minDistance(p *Point) float64 {
+	if r.containsLon(p[0]) {
+		// the closest point is on our meridian
+		lat := math.Max(r.y1(), math.Min(r.y2(), p[1]))
+		return EarthRadius * toRadians(math.Abs(p[1]-lat))
+	}
+	return math.Min(meridianDistance(p, r.x1(), r.y1(), r.y2()), meridianDistance(p, r.x2(), r.y1(), r.y2()))
+}
+
+// meridianDistance returns the distance in meters between p and the meridian segment lon, [lat1, lat2]
+func meridianDistance(p *Point, lon, lat1, lat2 float64) float64 {
+	φ := toRadians(p[1])
+	dλ := toRadians(lon - p[0])
+	// latitude of the closest point on the whole meridian circle, the distance grows monotonically around it
+	closest := toDegrees(math.Atan2(math.Sin(φ), math.Cos(φ)*math.Cos(dλ)))
+	if closest >= lat1 && closest <= lat2 {
+		return haversine(p[0], p[1], lon, closest)
+	}
+	// otherwise one of the ends of the segment is the closest
+	return math.Min(haversine(p[0], p[1], lon, lat1), haversine(p[0], p[1], lon, lat2))
+}
+
 func (r *Rect) containsRect(o *Rect) bool {
+	if o.wraps() {
+		halves := o.splitAntimeridian()
+		return r.containsRect(&halves[0]) && r.containsRect(&halves[1])
+	}
+	if r.wraps() {
+		halves := r.splitAntimeridian()
+		return halves[0].containsRect(o) || halves[1].containsRect(o)
+	}
 	return r[0] <= o[0] && r[1] <= o[1] && r[2] >= o[2] && r[3] >= o[3]
 }
 func (r *Rect) x1() float64 {
@@ -47,6 +142,9 @@ func (r *Rect) ok() bool {
 	return r.width() > 0 && r.height() > 0
 }
 func (r *Rect) width() float64 {
+	if r.wraps() {
+		return 360 - r.x1() + r.x2()
+	}
 	return r.x2() - r.x1()
 }
 func (r *Rect) height() float64 {
@@ -97,6 +195,14 @@ func (r *Rect) split4() [4]Rect {
 	}
 }
 func (r *Rect) intersects(s *Rect) bool {
+	if r.wraps() {
+		halves := r.splitAntimeridian()
+		return halves[0].intersects(s) || halves[1].intersects(s)
+	}
+	if s.wraps() {
+		halves := s.splitAntimeridian()
+		return r.intersects(&halves[0]) || r.intersects(&halves[1])
+	}
 	return !((s[0] < r[0] && s[2] < r[0]) || (s[0] > r[2] && s[2] > r[2]) ||
 		(s[1] < r[1] && s[3] < r[1]) || (s[1] > r[3] && s[3] > r[3]))
 }
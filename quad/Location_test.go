@@ -57,6 +57,21 @@ func TestRectContainsRect(t *testing.T) {
 		t.Fail()
 	}
 }
+func TestRectContainsAcrossAntimeridian(t *testing.T) {
+	region := NewRect(170, -10, -170, 10)
+	inside, outside := NewPoint(-175, 5), NewPoint(0, 5)
+	if !region.Contains(&inside) || region.Contains(&outside) {
+		t.Fail()
+	}
+	view := NewRect(175, 0, -175, 5)
+	if !region.ContainsRect(&view) {
+		t.Fail()
+	}
+	view = NewRect(175, 0, -165, 5)
+	if region.ContainsRect(&view) {
+		t.Fail()
+	}
+}
 func TestRectSplit4(t *testing.T) {
 	r := NewRect(-1, -1, 1, 1)
 	q := r.split4()
@@ -91,3 +106,82 @@ func TestIntersect(t *testing.T) {
 func (r Rect) containsPoint(p Point) bool {
 	return r[0] <= p[0] && r[1] <= p[1] && r[2] >= p[0] && r[3] >= p[1]
 }
+
+func TestDistanceTo(t *testing.T) {
+	paris := NewPoint(2.3522, 48.8566)
+	london := NewPoint(-0.1276, 51.5072)
+	d := paris.DistanceTo(&london)
+	if d < 343000 || d > 345000 {
+		t.Errorf("Paris-London should be about 344km, got %f", d)
+	}
+	if paris.DistanceTo(&paris) != 0 {
+		t.Error("Distance to self should be 0")
+	}
+	west := NewPoint(179.9, 0)
+	east := NewPoint(-179.9, 0)
+	if d := west.DistanceTo(&east); d > 23000 {
+		t.Errorf("Distance across the antimeridian should be short, got %f", d)
+	}
+}
+
+func TestRectMinDistance(t *testing.T) {
+	r := NewRect(0, 0, 10, 10)
+	inside := NewPoint(5, 5)
+	if r.minDistance(&inside) != 0 {
+		t.Error("A point inside the rect should be at distance 0")
+	}
+	for i := 0; i < 1000; i++ {
+		p := randomPoint()
+		min := r.minDistance(&p)
+		// sample the rect's border: no point may be closer than minDistance
+		for j := 0.0; j <= 10; j += 0.5 {
+			for _, border := range []Point{{j, 0}, {j, 10}, {0, j}, {10, j}} {
+				if p.DistanceTo(&border) < min-1e-6 {
+					t.Fatalf("minDistance %f from %v overestimates, %v is at %f", min, p, border, p.DistanceTo(&border))
+				}
+			}
+		}
+	}
+}
+
+func TestRectWrapping(t *testing.T) {
+	r := NewRect(170, -10, -170, 10)
+	if !r.wraps() || !r.IsValid() {
+		t.Error("Rect should be a valid wrapping rect")
+	}
+	if r.width() != 20 {
+		t.Errorf("Wrapping rect width should be 20, got %f", r.width())
+	}
+	for _, p := range []Point{{175, 0}, {-175, 0}, {180, 10}, {-180, -10}} {
+		if !r.contains(&p) {
+			t.Errorf("Wrapping rect should contain %v", p)
+		}
+	}
+	for _, p := range []Point{{0, 0}, {165, 0}, {-165, 0}, {175, 11}} {
+		if r.contains(&p) {
+			t.Errorf("Wrapping rect shouldn't contain %v", p)
+		}
+	}
+
+	inside := NewRect(175, -5, 179, 5)
+	across := NewRect(175, -5, -175, 5)
+	outside := NewRect(0, -5, 10, 5)
+	if !r.containsRect(&inside) || !r.containsRect(&across) || r.containsRect(&outside) {
+		t.Error("Wrapping rect containsRect is wrong")
+	}
+	world := NewRect(-180, -90, 180, 90)
+	east := NewRect(0, -90, 180, 90)
+	if !world.containsRect(&r) || east.containsRect(&r) {
+		t.Error("Only a full band can contain a wrapping rect")
+	}
+
+	west := NewRect(-180, 0, -175, 5)
+	if !r.intersects(&west) || !west.intersects(&r) || r.intersects(&outside) || outside.intersects(&r) {
+		t.Error("Wrapping rect intersects is wrong")
+	}
+
+	inverted := NewRect(0, 10, 10, 0)
+	if inverted.IsValid() {
+		t.Error("y1 > y2 should be invalid")
+	}
+}
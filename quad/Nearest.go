@@ -0,0 +1,89 @@
+package quad
+
+import "container/heap"
+
+// PointAcceptor allows searching among PointLike objects
+type PointAcceptor func(PointLike) bool
+
+// AcceptAllPoints can be used to not filter pointlike
+func AcceptAllPoints(PointLike) bool {
+	return true
+}
+
+// candidate is either a Quad or a PointLike waiting to be visited, with its distance to the search center
+type candidate struct {
+	distance float64
+	quad     Quad
+	point    PointLike
+}
+
+// candidateQueue is a min-heap of candidates, closest first
+type candidateQueue []candidate
+
+func (cq candidateQueue) Len() int           { return len(cq) }
+func (cq candidateQueue) Less(i, j int) bool { return cq[i].distance < cq[j].distance }
+func (cq candidateQueue) Swap(i, j int)      { cq[i], cq[j] = cq[j], cq[i] }
+
+func (cq *candidateQueue) Push(x interface{}) {
+	*cq = append(*cq, x.(candidate))
+}
+
+func (cq *candidateQueue) Pop() interface{} {
+	old := *cq
+	n := len(old)
+	c := old[n-1]
+	*cq = old[:n-1]
+	return c
+}
+
+// GetNearestPoints returns the k accepted points closest to center, closest first
+// maxMeters limits the search to a great-circle distance, use 0 for no limit
+func (q *Node) GetNearestPoints(center *Point, k int, maxMeters float64, acceptor PointAcceptor) []PointLike {
+	return nearest(q, center, k, maxMeters, acceptor)
+}
+
+// GetNearestPoints returns the k accepted points closest to center, closest first
+func (q *Leaf) GetNearestPoints(center *Point, k int, maxMeters float64, acceptor PointAcceptor) []PointLike {
+	return nearest(q, center, k, maxMeters, acceptor)
+}
+
+// nearest is a best-first search: subtrees are visited in order of their minimum distance to center
+// so points come out of the queue in order, and we can stop as soon as we have k of them
+func nearest(root Quad, center *Point, k int, maxMeters float64, acceptor PointAcceptor) []PointLike {
+	res := []PointLike{}
+	if k <= 0 {
+		return res
+	}
+
+	queue := &candidateQueue{{distance: 0, quad: root}}
+	for queue.Len() > 0 && len(res) < k {
+		c := heap.Pop(queue).(candidate)
+		if c.point != nil {
+			res = append(res, c.point)
+			continue
+		}
+
+		switch leafOrNode := c.quad.(type) {
+		case *Leaf:
+			for _, each := range leafOrNode.points {
+				if acceptor != nil && !acceptor(each) {
+					continue
+				}
+				distance := center.DistanceTo(each.GetPoint())
+				if maxMeters > 0 && distance > maxMeters {
+					continue
+				}
+				heap.Push(queue, candidate{distance: distance, point: each})
+			}
+		case *Node:
+			for _, sub := range leafOrNode.sub {
+				distance := sub.getRect().minDistance(center)
+				if maxMeters > 0 && distance > maxMeters {
+					continue
+				}
+				heap.Push(queue, candidate{distance: distance, quad: sub})
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+package quad
+
+import (
+	"sort"
+	"testing"
+)
+
+type otherPointLikeObj struct {
+	PointLikeObj
+}
+
+func TestGetNearestPoints(t *testing.T) {
+	MinDepth = 4
+	defer func() { MinDepth = 0 }()
+	q := NewQuad()
+	points := []PointLike{}
+	for i := 0; i < 2000; i++ {
+		var po PointLike = &PointLikeObj{p: randomPoint(), n: nil}
+		if i%2 == 0 {
+			po = &otherPointLikeObj{PointLikeObj{p: randomPoint(), n: nil}}
+		}
+		q.AddPoint(po)
+		points = append(points, po)
+	}
+	onlyPointLikeObj := func(p PointLike) bool {
+		_, ok := p.(*PointLikeObj)
+		return ok
+	}
+
+	for i := 0; i < 50; i++ {
+		center := randomPoint()
+		found := q.GetNearestPoints(&center, 10, 0, onlyPointLikeObj)
+		if len(found) != 10 {
+			t.Fatalf("There should be 10 results, there are %d", len(found))
+		}
+
+		expected := []PointLike{}
+		for _, each := range points {
+			if onlyPointLikeObj(each) {
+				expected = append(expected, each)
+			}
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			return center.DistanceTo(expected[i].GetPoint()) < center.DistanceTo(expected[j].GetPoint())
+		})
+		for index, each := range found {
+			if each != expected[index] {
+				t.Errorf("Result %d for %v should be %v, got %v", index, center, expected[index].GetPoint(), each.GetPoint())
+			}
+		}
+	}
+
+	center := NewPoint(0, 0)
+	all := q.GetNearestPoints(&center, len(points), 1000000, AcceptAllPoints)
+	for _, each := range all {
+		if center.DistanceTo(each.GetPoint()) > 1000000 {
+			t.Error("Search returned a point further than maxMeters")
+		}
+	}
+	if len(q.GetNearestPoints(&center, 0, 0, nil)) != 0 {
+		t.Error("Searching for 0 points should return nothing")
+	}
+}
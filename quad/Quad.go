@@ -43,7 +43,10 @@ type Quad interface {
 	MoveRect(RectLike, *Rect)
 
 	GetPointsIn(*Rect) []PointLike
+	GetPointsWithinRadius(*Point, float64) []PointLike
+	GetNearestPoints(*Point, int, float64, PointAcceptor) []PointLike
 	GetRectsWithPoint(*Point, RectAcceptor) set.Set
+	GetRectsIntersecting(*Rect, RectAcceptor) set.Set
 
 	countRects() int
 	isLeaf() bool
@@ -53,6 +56,7 @@ type Quad interface {
 // Element stores the nodes used by a RectLike (1,2 or 4)
 type Element struct {
 	node1, node2, node3, node4 *Node
+	wrapped                    *Element // the western half of a rect crossing the antimeridian
 }
 
 // Node is a Node in a quad-tree
@@ -163,16 +167,26 @@ func (q *Node) findLeafWith(point *Point) *Leaf {
 }
 
 // AddRect adds a RectLike to the tree
+// Rects crossing the antimeridian are stored as two halves
 func (q *Node) AddRect(r RectLike) {
 	rect := r.GetRect()
+	if !rect.wraps() {
+		r.SetNode(q.addRect(r, rect))
+		return
+	}
+	halves := rect.splitAntimeridian()
+	element := q.addRect(r, &halves[0])
+	element.wrapped = q.addRect(r, &halves[1])
+	r.SetNode(element)
+}
 
+// addRect stores r at the position of rect, which must not wrap
+func (q *Node) addRect(r RectLike, rect *Rect) *Element {
 	// if it won't fit anywhere, it's larger than our children, that's the condition to stop recursion
 	if 2*rect.width() > q.rect.width() || 2*rect.height() > q.rect.height() {
 		// it's too large to fit anywhere, so add to ourself
-		element := &Element{q, nil, nil, nil}
 		q.rects = append(q.rects, r)
-		r.SetNode(element)
-		return
+		return &Element{node1: q}
 	}
 
 	// try to fit it in a child if possible
@@ -182,11 +196,9 @@ func (q *Node) AddRect(r RectLike) {
 			case *Leaf:
 				newNode := leafOrNode.convertToNode()
 				q.sub[index] = newNode
-				newNode.AddRect(r)
-				return
+				return newNode.addRect(r, rect)
 			case *Node:
-				leafOrNode.AddRect(r)
-				return
+				return leafOrNode.addRect(r, rect)
 			}
 		}
 	}
@@ -198,13 +210,13 @@ func (q *Node) AddRect(r RectLike) {
 			log.Print("we're in a node at level ", q.level)
 			log.Print("our rect is ", q.rect)
 			log.Print("center is ", q.rect.center())
-			log.Print("rect to split is ", *r.GetRect())
+			log.Print("rect to split is ", *rect)
 			for _, q := range q.sub {
 				log.Print("sub rect ", *q.getRect())
 			}
 		}
 	}()
-	res := r.GetRect().splitAround(q.rect.center())
+	res := rect.splitAround(q.rect.center())
 	var node1, node2, node3, node4 *Node
 	node1 = q.findOrCreateNodeForRect(res[0])
 	node2 = q.findOrCreateNodeForRect(res[1])
@@ -218,8 +230,7 @@ func (q *Node) AddRect(r RectLike) {
 		node3.addSplitRect(r)
 		node4.addSplitRect(r)
 	}
-	element := &Element{node1, node2, node3, node4}
-	r.SetNode(element)
+	return &Element{node1: node1, node2: node2, node3: node3, node4: node4}
 }
 func (q *Node) addSplitRect(r RectLike) {
 	q.rects = append(q.rects, r)
@@ -249,6 +260,14 @@ func (q *Node) RemoveRect(r RectLike) {
 	if el == nil {
 		return
 	}
+	el.remove(r)
+	if el.wrapped != nil {
+		el.wrapped.remove(r)
+	}
+	r.SetNode(nil)
+}
+
+func (el *Element) remove(r RectLike) {
 	el.node1.removeFromRects(r)
 	el.node1.purge()
 	if el.node2 != nil {
@@ -261,7 +280,6 @@ func (q *Node) RemoveRect(r RectLike) {
 		el.node4.removeFromRects(r)
 		el.node4.purge()
 	}
-	r.SetNode(nil)
 }
 func (q *Node) removeFromRects(r RectLike) {
 	foundindex := -1
@@ -330,6 +348,17 @@ func (q *Node) GetPointsIn(r *Rect) []PointLike {
 	return res
 }
 
+// GetPointsWithinRadius returns all the points within a great-circle distance (in meters) of center
+func (q *Node) GetPointsWithinRadius(center *Point, meters float64) []PointLike {
+	res := []PointLike{}
+	for _, quad := range q.sub {
+		if quad.getRect().minDistance(center) <= meters {
+			res = append(res, quad.GetPointsWithinRadius(center, meters)...)
+		}
+	}
+	return res
+}
+
 // GetRectsWithPoint returns all the rects stored in the tree that contain a point
 func (q *Node) GetRectsWithPoint(p *Point, a RectAcceptor) set.Set {
 	empty := set.NewThreadUnsafeSet()
@@ -356,6 +385,29 @@ func (q *Node) getRectsWithPoint(p *Point, acceptor RectAcceptor, acc set.Set) s
 	}
 }
 
+// GetRectsIntersecting returns all the rects stored in the tree that intersect a rect
+func (q *Node) GetRectsIntersecting(r *Rect, a RectAcceptor) set.Set {
+	empty := set.NewThreadUnsafeSet()
+	return q.getRectsIntersecting(r, a, empty)
+}
+
+// recursive
+func (q *Node) getRectsIntersecting(r *Rect, acceptor RectAcceptor, acc set.Set) set.Set {
+	for _, rectLike := range q.rects {
+		if rectLike.GetRect().intersects(r) {
+			if acceptor == nil || acceptor(rectLike) {
+				acc.Add(rectLike)
+			}
+		}
+	}
+	for _, quad := range q.sub {
+		if node, isNode := quad.(*Node); isNode && node.rect.intersects(r) {
+			node.getRectsIntersecting(r, acceptor, acc)
+		}
+	}
+	return acc
+}
+
 // GetRect returns the bouding box of the rect
 func (q *Node) getRect() *Rect {
 	return &q.rect
@@ -449,6 +501,17 @@ func (q *Leaf) GetPointsIn(r *Rect) []PointLike {
 	}
 	return res
 }
+
+// GetPointsWithinRadius returns all the PointLike objects within a great-circle distance (in meters) of center
+func (q *Leaf) GetPointsWithinRadius(center *Point, meters float64) []PointLike {
+	res := []PointLike{}
+	for _, each := range q.points {
+		if center.DistanceTo(each.GetPoint()) <= meters {
+			res = append(res, each)
+		}
+	}
+	return res
+}
 func (q *Leaf) convertToNode() *Node {
 	node := newNode(q.rect, q.level, q.parent)
 	for _, p := range q.points {
@@ -465,3 +528,9 @@ func (q *Leaf) GetRectsWithPoint(*Point, RectAcceptor) set.Set {
 	log.Print("leafs shouldn't look for points directly")
 	return nil
 }
+
+// GetRectsIntersecting returns all the rects that intersect a rect
+func (q *Leaf) GetRectsIntersecting(*Rect, RectAcceptor) set.Set {
+	log.Print("leafs shouldn't look for rects directly")
+	return nil
+}
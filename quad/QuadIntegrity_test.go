@@ -18,7 +18,7 @@ func (q *Node) checkIntegrity() {
 	}
 	for _, rect := range q.rects {
 		el := rect.GetNode()
-		if el.node1 != q && el.node2 != q && el.node3 != q && el.node4 != q {
+		if !el.references(q) && (el.wrapped == nil || !el.wrapped.references(q)) {
 			log.Fatal("Node contains element with no reference to Node")
 		}
 		if el.node3 != nil && el.node4 == nil {
@@ -41,6 +41,10 @@ func (q *Node) checkIntegrity() {
 
 	}
 }
+func (el *Element) references(q *Node) bool {
+	return el.node1 == q || el.node2 == q || el.node3 == q || el.node4 == q
+}
+
 func (q *Leaf) checkIntegrity() {
 	foundInParentsSub := false
 	for _, quad := range q.parent.sub {
@@ -168,6 +168,92 @@ func TestAddRect(t *testing.T) {
 	}
 }
 
+func TestWrappingRect(t *testing.T) {
+	q := NewQuad()
+
+	r := NewRect(170, -10, -170, 10)
+	ro := &RectLikeObj{r: r, n: nil}
+	q.AddRect(ro)
+	if ro.GetNode().wrapped == nil {
+		t.Fatal("A wrapping rect should be stored as two halves")
+	}
+	q.(*Node).checkIntegrity()
+
+	east := &PointLikeObj{NewPoint(175, 0), nil}
+	west := &PointLikeObj{NewPoint(-175, 0), nil}
+	elsewhere := &PointLikeObj{NewPoint(0, 0), nil}
+	q.AddPoint(east)
+	q.AddPoint(west)
+	q.AddPoint(elsewhere)
+
+	for _, p := range []*PointLikeObj{east, west} {
+		rects := q.GetRectsWithPoint(p.GetPoint(), AcceptAll).ToSlice()
+		if len(rects) != 1 || rects[0] != ro {
+			t.Errorf("The wrapping rect should be found for %v", p.GetPoint())
+		}
+	}
+	if q.GetRectsWithPoint(elsewhere.GetPoint(), AcceptAll).Cardinality() != 0 {
+		t.Error("The wrapping rect shouldn't be found for 0,0")
+	}
+
+	points := q.GetPointsIn(&r)
+	if len(points) != 2 {
+		t.Errorf("There should be 2 points in the wrapping rect, there are %d", len(points))
+	}
+
+	moved := NewRect(-10, -10, 10, 10)
+	q.MoveRect(ro, &moved)
+	if ro.GetNode().wrapped != nil {
+		t.Error("A moved rect shouldn't wrap anymore")
+	}
+	rects := q.GetRectsWithPoint(elsewhere.GetPoint(), AcceptAll).ToSlice()
+	if len(rects) != 1 || rects[0] != ro {
+		t.Error("The moved rect should be found for 0,0")
+	}
+
+	q.MoveRect(ro, &r)
+	q.RemoveRect(ro)
+	if count, _ := q.(*Node).countRectsAndNodes(); count != 0 {
+		t.Errorf("There should be no rects left in the tree, there are %d", count)
+	}
+	q.(*Node).checkIntegrity()
+}
+
+func TestGetRectsIntersecting(t *testing.T) {
+	MinDepth = 4
+	defer func() { MinDepth = 0 }()
+	q := NewQuad()
+	rects := []RectLike{}
+	for i := 0; i < 1000; i++ {
+		ro := &RectLikeObj{r: randomRect(randomPoint()), n: nil}
+		q.AddRect(ro)
+		rects = append(rects, ro)
+	}
+	wrapping := &RectLikeObj{r: NewRect(178, -5, -178, 5), n: nil}
+	q.AddRect(wrapping)
+	rects = append(rects, wrapping)
+
+	searches := []Rect{NewRect(179, -1, -179, 1), NewRect(-180, -90, 180, 90)}
+	for i := 0; i < 50; i++ {
+		searches = append(searches, randomRect(randomPoint()))
+	}
+	for _, search := range searches {
+		found := q.GetRectsIntersecting(&search, AcceptAll)
+		count := 0
+		for _, each := range rects {
+			if each.GetRect().intersects(&search) {
+				count++
+				if !found.Contains(each) {
+					t.Errorf("Rect %v intersecting %v wasn't found", each.GetRect(), search)
+				}
+			}
+		}
+		if count != found.Cardinality() {
+			t.Errorf("Wrong number of rects intersecting %v: %d instead of %d", search, found.Cardinality(), count)
+		}
+	}
+}
+
 func TestMovePoint(t *testing.T) {
 	q := NewQuad()
 
@@ -208,6 +294,38 @@ func TestMovePoint(t *testing.T) {
 	}
 }
 
+func TestGetPointsWithinRadius(t *testing.T) {
+	MinDepth = 4
+	defer func() { MinDepth = 0 }()
+	q := NewQuad()
+	points := []PointLike{}
+	for i := 0; i < 2000; i++ {
+		po := &PointLikeObj{p: randomPoint(), n: nil}
+		q.AddPoint(po)
+		points = append(points, po)
+	}
+
+	for i := 0; i < 50; i++ {
+		center := randomPoint()
+		meters := rand.Float64() * 2000000
+		found := q.GetPointsWithinRadius(&center, meters)
+		for _, each := range found {
+			if center.DistanceTo(each.GetPoint()) > meters {
+				t.Error("Search returned a point outside of the radius")
+			}
+		}
+		count := 0
+		for _, each := range points {
+			if center.DistanceTo(each.GetPoint()) <= meters {
+				count++
+			}
+		}
+		if count != len(found) {
+			t.Errorf("Wrong number of points within %fm of %v: %d instead of %d", meters, center, len(found), count)
+		}
+	}
+}
+
 func TestQuadIntegrity(t *testing.T) {
 	MinDepth = 6
 	q := NewQuad()
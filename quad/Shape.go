@@ -0,0 +1,115 @@
+package quad
+
+import "math"
+
+// Shape is an area with an exact containment test
+// Shapes are stored in quads by their bounding Rect
+type Shape interface {
+	BoundingRect() Rect
+	ContainsPoint(*Point) bool
+}
+
+// Polygon models a polygon as rings of points: the outer ring first, then its holes
+// Rings are implicitly closed, and they can't cross the antimeridian
+type Polygon [][]Point
+
+// IsValid checks that each ring has at least 3 valid points and doesn't cross the antimeridian
+func (poly Polygon) IsValid() bool {
+	if len(poly) == 0 {
+		return false
+	}
+	for _, ring := range poly {
+		if len(ring) < 3 {
+			return false
+		}
+		for index := range ring {
+			p, next := ring[index], ring[(index+1)%len(ring)]
+			if !p.IsValid() || math.Abs(next[0]-p[0]) > 180 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// BoundingRect returns the bounding box of the outer ring
+func (poly Polygon) BoundingRect() Rect {
+	r := Rect{180, 90, -180, -90}
+	for _, p := range poly[0] {
+		r[0] = math.Min(r[0], p[0])
+		r[1] = math.Min(r[1], p[1])
+		r[2] = math.Max(r[2], p[0])
+		r[3] = math.Max(r[3], p[1])
+	}
+	return r
+}
+
+// ContainsPoint returns true if p is inside the outer ring and outside all the holes
+func (poly Polygon) ContainsPoint(p *Point) bool {
+	if !ringContains(poly[0], p) {
+		return false
+	}
+	for _, hole := range poly[1:] {
+		if ringContains(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Circle models a circle with a center and a radius in meters
+type Circle struct {
+	Center Point   `json:"center"`
+	Radius float64 `json:"radius"`
+}
+
+// IsValid checks the center and the radius
+func (c Circle) IsValid() bool {
+	return c.Center.IsValid() && c.Radius > 0
+}
+
+// BoundingRect returns the bounding box of the circle
+// it wraps around the antimeridian if needed, and spans all longitudes if the circle contains a pole
+func (c Circle) BoundingRect() Rect {
+	d := MetersToDegrees(c.Radius)
+	lat := c.Center[1]
+	y1, y2 := lat-d, lat+d
+	if y1 <= -90 || y2 >= 90 {
+		return Rect{-180, math.Max(y1, -90), 180, math.Min(y2, 90)}
+	}
+
+	sinDLon := math.Sin(toRadians(d)) / math.Cos(toRadians(lat))
+	if sinDLon >= 1 {
+		return Rect{-180, y1, 180, y2}
+	}
+	dLon := toDegrees(math.Asin(sinDLon))
+	return Rect{wrapX(c.Center[0] - dLon), y1, wrapX(c.Center[0] + dLon), y2}
+}
+
+// ContainsPoint returns true if p is within the radius of the center
+func (c Circle) ContainsPoint(p *Point) bool {
+	return c.Center.DistanceTo(p) <= c.Radius
+}
+
+func wrapX(x float64) float64 {
+	if x < -180 {
+		return x + 360
+	}
+	if x > 180 {
+		return x - 360
+	}
+	return x
+}
+
+// ringContains casts a ray from p towards the east and counts crossed edges (even-odd rule)
+func ringContains(ring []Point, p *Point) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) &&
+			p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
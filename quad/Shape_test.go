@@ -0,0 +1,88 @@
+package quad
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPolygon(t *testing.T) {
+	square := []Point{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	hole := []Point{{4, 4}, {6, 4}, {6, 6}, {4, 6}}
+	poly := Polygon{square, hole}
+
+	if !poly.IsValid() {
+		t.Error("Polygon should be valid")
+	}
+	if r := poly.BoundingRect(); r != NewRect(0, 0, 10, 10) {
+		t.Errorf("Wrong bounding rect %v", r)
+	}
+	for _, p := range []Point{{1, 1}, {9, 5}, {5, 9}, {3, 5}} {
+		if !poly.ContainsPoint(&p) {
+			t.Errorf("Polygon should contain %v", p)
+		}
+	}
+	for _, p := range []Point{{5, 5}, {-1, 5}, {11, 5}, {5, 11}, {4.5, 5.5}} {
+		if poly.ContainsPoint(&p) {
+			t.Errorf("Polygon shouldn't contain %v", p)
+		}
+	}
+
+	// a concave "L"
+	l := Polygon{{{0, 0}, {10, 0}, {10, 2}, {2, 2}, {2, 10}, {0, 10}}}
+	if outside := (Point{5, 5}); l.ContainsPoint(&outside) {
+		t.Error("Concave polygon shouldn't contain its notch")
+	}
+	if inside := (Point{1, 9}); !l.ContainsPoint(&inside) {
+		t.Error("Concave polygon should contain its arm")
+	}
+
+	invalid := []Polygon{
+		{},
+		{{{0, 0}, {1, 1}}},
+		{{{0, 0}, {10, 0}, {10, 200}}},
+		{{{170, 0}, {-170, 0}, {-170, 10}}},
+	}
+	for _, each := range invalid {
+		if each.IsValid() {
+			t.Errorf("Polygon %v should be invalid", each)
+		}
+	}
+}
+
+func TestCircle(t *testing.T) {
+	c := Circle{NewPoint(2.3522, 48.8566), 1000}
+	if !c.IsValid() {
+		t.Error("Circle should be valid")
+	}
+	if (Circle{NewPoint(0, 0), 0}).IsValid() {
+		t.Error("Circle with no radius should be invalid")
+	}
+	near := NewPoint(2.36, 48.86)
+	far := NewPoint(2.4, 48.86)
+	if !c.ContainsPoint(&near) || c.ContainsPoint(&far) {
+		t.Error("Circle ContainsPoint is wrong")
+	}
+
+	for i := 0; i < 200; i++ {
+		c := Circle{randomPoint(), rand.Float64() * 3000000}
+		bbox := c.BoundingRect()
+		if !bbox.IsValid() {
+			t.Fatalf("Invalid bounding rect %v for %v", bbox, c)
+		}
+		for j := 0; j < 200; j++ {
+			p := randomPoint()
+			if c.ContainsPoint(&p) && !bbox.contains(&p) {
+				t.Fatalf("Bounding rect %v of %v doesn't contain %v", bbox, c, p)
+			}
+		}
+	}
+
+	fiji := Circle{NewPoint(179.5, -17), 200000}
+	if bbox := fiji.BoundingRect(); !bbox.wraps() {
+		t.Errorf("Bounding rect %v should wrap around the antimeridian", bbox)
+	}
+	pole := Circle{NewPoint(0, 89), 200000}
+	if bbox := pole.BoundingRect(); bbox.width() != 360 {
+		t.Errorf("Bounding rect %v should span all longitudes", bbox)
+	}
+}
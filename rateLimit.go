@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Rate commands per second on average, up to Burst at once
+type RateLimit struct {
+	Rate  float64 `json:"rate"`            // 0 for no limit
+	Burst float64 `json:"burst,omitempty"` // defaults to Rate, at least 1
+}
+
+func (l RateLimit) burst() float64 {
+	return math.Max(1, math.Max(l.Burst, l.Rate))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the commands of a token, by command name
+// it's shared by the websockets of the same agent and view
+type rateLimiter struct {
+	sync.Mutex
+	sessions int // using the limiter
+
+	limits  map[string]RateLimit
+	buckets map[string]*tokenBucket
+
+	hits        int // commands rejected since windowStart
+	windowStart time.Time
+}
+
+// newRateLimiter uses the limits of a token, and DefaultRateLimits for the commands it doesn't limit
+func newRateLimiter(limits map[string]RateLimit) *rateLimiter {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	l.setLimits(limits)
+	return l
+}
+
+// setLimits replaces the limits, buckets are kept
+func (l *rateLimiter) setLimits(limits map[string]RateLimit) {
+	l.Lock()
+	defer l.Unlock()
+
+	merged := make(map[string]RateLimit, len(DefaultRateLimits))
+	for command, limit := range DefaultRateLimits {
+		merged[command] = limit
+	}
+	for command, limit := range limits {
+		merged[command] = limit
+	}
+	l.limits = merged
+}
+
+// allow returns true if command can be handled now, and takes a token from its bucket
+func (l *rateLimiter) allow(command string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	limit, found := l.limits[command]
+	if !found || limit.Rate <= 0 {
+		return true
+	}
+
+	bucket, found := l.buckets[command]
+	if !found {
+		bucket = &tokenBucket{tokens: limit.burst(), last: now}
+		l.buckets[command] = bucket
+	}
+	bucket.tokens = math.Min(limit.burst(), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		l.hit(now)
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *rateLimiter) hit(now time.Time) {
+	if now.Sub(l.windowStart) > RateLimitWindow {
+		l.windowStart = now
+		l.hits = 0
+	}
+	l.hits++
+}
+
+// abusive returns true when more than MaxRateLimitHits commands were rejected within RateLimitWindow
+func (l *rateLimiter) abusive() bool {
+	l.Lock()
+	defer l.Unlock()
+	return MaxRateLimitHits > 0 && l.hits > MaxRateLimitHits
+}
+
+// limiterKey identifies the sessions sharing a rateLimiter
+type limiterKey struct {
+	agentID string
+	viewID  string
+}
+
+// acquireLimiter returns the rateLimiter of the agent and view of token, with its limits
+// so that opening more websockets doesn't give more commands
+func (wsh *WSRouter) acquireLimiter(token *JWTToken) *rateLimiter {
+	key := limiterKey{token.AgentID, token.ViewID}
+
+	wsh.limitersLock.Lock()
+	defer wsh.limitersLock.Unlock()
+	l, found := wsh.limiters[key]
+	if found {
+		l.setLimits(token.Capabilities.RateLimits)
+	} else {
+		l = newRateLimiter(token.Capabilities.RateLimits)
+		wsh.limiters[key] = l
+	}
+	l.sessions++
+	return l
+}
+
+// releaseLimiter forgets the rateLimiter of token when its last session is closed
+func (wsh *WSRouter) releaseLimiter(token *JWTToken) {
+	key := limiterKey{token.AgentID, token.ViewID}
+
+	wsh.limitersLock.Lock()
+	defer wsh.limitersLock.Unlock()
+	if l, found := wsh.limiters[key]; found {
+		l.sessions--
+		if l.sessions <= 0 {
+			delete(wsh.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(map[string]RateLimit{"agentPosition": {Rate: 2, Burst: 4}})
+	now := time.Now()
+
+	tests := []struct {
+		after   time.Duration // since the previous command
+		allowed bool
+	}{
+		{0, true}, {0, true}, {0, true}, {0, true}, // the burst
+		{0, false},
+		{250 * time.Millisecond, false}, // half a token
+		{250 * time.Millisecond, true},
+		{0, false},
+		{time.Minute, true}, // refilled up to the burst only
+		{0, true}, {0, true}, {0, true},
+		{0, false},
+	}
+	for i, test := range tests {
+		now = now.Add(test.after)
+		if allowed := l.allow("agentPosition", now); allowed != test.allowed {
+			t.Errorf("command %d: allowed is %v, expected %v", i, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterLimits(t *testing.T) {
+	defaults := DefaultRateLimits
+	defer func() { DefaultRateLimits = defaults }()
+	DefaultRateLimits = map[string]RateLimit{"createPOI": {Rate: 1}, "sendEvent": {Rate: 1}}
+
+	l := newRateLimiter(map[string]RateLimit{"sendEvent": {Rate: 0}, "nearest": {Rate: 0.5}})
+	now := time.Now()
+
+	tests := []struct {
+		command string
+		allowed []bool
+	}{
+		{"createPOI", []bool{true, false}}, // the default, with a burst of 1
+		{"sendEvent", []bool{true, true}},  // the token removes the limit
+		{"nearest", []bool{true, false}},   // the token adds a limit
+		{"removePOI", []bool{true, true}},  // not limited
+	}
+	for _, test := range tests {
+		for i, expected := range test.allowed {
+			if allowed := l.allow(test.command, now); allowed != expected {
+				t.Errorf("%s %d: allowed is %v, expected %v", test.command, i, allowed, expected)
+			}
+		}
+	}
+
+	// buckets are kept when the limits change
+	l.setLimits(map[string]RateLimit{"createPOI": {Rate: 1, Burst: 5}})
+	if l.allow("createPOI", now) {
+		t.Error("the bucket of createPOI was refilled by setLimits")
+	}
+	if !l.allow("nearest", now) {
+		t.Error("nearest is still limited after setLimits")
+	}
+}
+
+func TestRateLimiterAbusive(t *testing.T) {
+	maxHits, window := MaxRateLimitHits, RateLimitWindow
+	defer func() { MaxRateLimitHits, RateLimitWindow = maxHits, window }()
+	MaxRateLimitHits, RateLimitWindow = 3, 10*time.Second
+
+	l := newRateLimiter(map[string]RateLimit{"agentPosition": {Rate: 0.001}})
+	now := time.Now()
+	l.allow("agentPosition", now)
+
+	tests := []struct {
+		after   time.Duration // since the previous command
+		abusive bool
+	}{
+		{0, false}, {time.Second, false}, {time.Second, false},
+		{time.Second, true},       // 4 hits within the window
+		{11 * time.Second, false}, // a new window
+		{time.Second, false}, {time.Second, false},
+		{time.Second, true},
+	}
+	for i, test := range tests {
+		now = now.Add(test.after)
+		l.allow("agentPosition", now)
+		if abusive := l.abusive(); abusive != test.abusive {
+			t.Errorf("hit %d: abusive is %v, expected %v", i, abusive, test.abusive)
+		}
+	}
+
+	MaxRateLimitHits = 0
+	if l.abusive() {
+		t.Error("abusive with MaxRateLimitHits 0")
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	wsh := &WSRouter{limiters: make(map[limiterKey]*rateLimiter)}
+	token := &JWTToken{AgentID: "a", ViewID: "v"}
+	token.Capabilities.RateLimits = map[string]RateLimit{"sendEvent": {Rate: 1}}
+	other := &JWTToken{AgentID: "a", ViewID: "w"}
+
+	first, second := wsh.acquireLimiter(token), wsh.acquireLimiter(token)
+	if first != second {
+		t.Fatal("websockets of the same agent and view don't share their limits")
+	}
+	if wsh.acquireLimiter(other) == first {
+		t.Fatal("websockets of different views share their limits")
+	}
+	now := time.Now()
+	if !first.allow("sendEvent", now) || second.allow("sendEvent", now) {
+		t.Error("the bucket isn't shared")
+	}
+
+	wsh.releaseLimiter(token)
+	if wsh.acquireLimiter(token) != first {
+		t.Error("the limiter was released while used")
+	}
+	wsh.releaseLimiter(token)
+	wsh.releaseLimiter(token)
+	if _, found := wsh.limiters[limiterKey{"a", "v"}]; found {
+		t.Error("the limiter wasn't released with its last session")
+	}
+}
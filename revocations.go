@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Revocation revokes a token by its jti, or all the tokens of an agent
+type Revocation struct {
+	JTI       string    `json:"jti,omitempty"`
+	AgentID   string    `json:"agentId,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+func (r *Revocation) check() error {
+	if (r.JTI == "") == (r.AgentID == "") {
+		return errors.New("A revocation needs either a jti or an agentId")
+	}
+	return nil
+}
+
+// key identifies the revocation in the revocation list and in the persister
+func (r *Revocation) key() string {
+	if r.JTI != "" {
+		return "jti:" + r.JTI
+	}
+	return "agent:" + r.AgentID
+}
+
+func (r *Revocation) revokes(token *JWTToken) bool {
+	return (r.JTI != "" && token.Id == r.JTI) || (r.AgentID != "" && token.AgentID == r.AgentID)
+}
+
+// revocationList holds the revocations, they're checked when parsing tokens
+type revocationList struct {
+	sync.RWMutex
+	revocations map[string]*Revocation // by key
+}
+
+var revocations = &revocationList{revocations: map[string]*Revocation{}}
+
+func (l *revocationList) add(r *Revocation) {
+	l.Lock()
+	defer l.Unlock()
+	l.revocations[r.key()] = r
+}
+
+func (l *revocationList) remove(r *Revocation) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.revocations, r.key())
+}
+
+// get returns the revocation with the same key as r, or nil
+func (l *revocationList) get(r *Revocation) *Revocation {
+	l.RLock()
+	defer l.RUnlock()
+	return l.revocations[r.key()]
+}
+
+// revokes returns the revocation of the token, or nil
+func (l *revocationList) revokes(token *JWTToken) *Revocation {
+	l.RLock()
+	defer l.RUnlock()
+	if token.Id != "" {
+		if r, found := l.revocations["jti:"+token.Id]; found {
+			return r
+		}
+	}
+	return l.revocations["agent:"+token.AgentID]
+}
+
+func (l *revocationList) list() []*Revocation {
+	l.RLock()
+	defer l.RUnlock()
+	res := make([]*Revocation, 0, len(l.revocations))
+	for _, r := range l.revocations {
+		res = append(res, r)
+	}
+	return res
+}
+
+// revokeSessions closes the sessions whose token is revoked by r, they can't be resumed
+func (wsh *WSRouter) revokeSessions(r *Revocation) int {
+	var live, suspended []*wsSession
+	wsh.sessionsLock.Lock()
+	for resumeToken, s := range wsh.sessions {
+		if !r.revokes(s.token) {
+			continue
+		}
+		if s.suspended {
+			delete(wsh.sessions, resumeToken)
+			suspended = append(suspended, s)
+		} else {
+			s.revoked = true
+			live = append(live, s)
+		}
+	}
+	wsh.sessionsLock.Unlock()
+
+	for _, s := range live {
+		log.Info(s.identity, ": token revoked, disconnecting")
+		s.ws.dropWithError(ErrTokenRevoked) // the read loop will close the session
+	}
+	for _, s := range suspended {
+		s.close()
+	}
+	return len(live) + len(suspended)
+}
+
+// revocationsHandleFunc lists (GET), adds (POST) and removes (DELETE) revocations
+// it needs the webhook bearer token
+func revocationsHandleFunc(persister Persister, wsh *WSRouter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+
+		if WebhookBearerToken == "" || (auth != WebhookBearerToken && req.URL.Query().Get("bearer") != WebhookBearerToken) {
+			w.WriteHeader(http.StatusUnauthorized)
+			log.Warn("Unauthorized attempt to manage revocations")
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+
+		if req.Method == http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(revocations.list())
+			return
+		}
+		if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+			writeHTTPError(w, "Revocations", ErrMethodNotAllowed.withDetail("Only GET, POST and DELETE are supported by this endpoint"))
+			return
+		}
+
+		r := &Revocation{}
+		if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+			writeHTTPError(w, "Revocations", ErrInvalidMessage.withDetail("Can't parse json body"))
+			return
+		}
+		if err := r.check(); err != nil {
+			writeHTTPError(w, "Revocations", invalidCommand(err))
+			return
+		}
+
+		switch req.Method {
+		case http.MethodPost:
+			r.RevokedAt = time.Now()
+			if err := persister.persistRevocation(r); err != nil {
+				writeHTTPError(w, "Revocations", err)
+				return
+			}
+			revocations.add(r)
+			closed := wsh.revokeSessions(r)
+			log.Info("POST /v1/revocations: ", r.key(), ", closed sessions: ", closed)
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(r)
+		case http.MethodDelete:
+			removed := revocations.get(r)
+			if removed == nil {
+				writeHTTPError(w, "Revocations", ErrRevocationNotFound)
+				return
+			}
+			if err := persister.removeRevocation(r); err != nil {
+				writeHTTPError(w, "Revocations", err)
+				return
+			}
+			revocations.remove(r)
+			log.Info("DELETE /v1/revocations: ", r.key())
+
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(removed)
+		}
+	}
+}
@@ -7,75 +7,397 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// overflow policies, applied when a connection has MaxQueuedMessages waiting to be written
+const (
+	// OverflowCoalesce still merges changes with the queued ones, and disconnects if they can't be merged
+	OverflowCoalesce = "coalesce"
+	// OverflowDrop drops new messages
+	OverflowDrop = "drop"
+	// OverflowDisconnect disconnects the client
+	OverflowDisconnect = "disconnect"
+)
+
 // WsConn models a ws connection
 // It's optimized to either send a JSON array of objects
 // or send an immediate JSON object
+// messages are encoded with the codec of the connection's subprotocol, JSON by default
+// messages are queued, and written by a dedicated goroutine
 type wsConn struct {
 	sync.Mutex
 	conn   *websocket.Conn
-	buffer []JSONChangeMessage
+	codec  codec
+	buffer []JSONChangeMessage // sent as an array every MessageSendInterval
+
+	// changes about the same agent or POI are coalesced until the buffer is flushed
+	lastChanges map[string]lastChange // by agent or POI
+	removed     int                   // changes merged with later ones, nil in the buffer
+
+	outbox    []interface{} // messages and arrays of messages, waiting to be written
+	outboxLen int           // number of messages in outbox
+	wake      chan struct{} // wakes the writer up
 
-	Name    string
-	closing bool
+	Name           string
+	closing        bool
+	receiveEvents  bool
+	flushScheduled bool
+	done           chan struct{} // closed when the connection is closed
+	detached       bool          // the websocket is lost, messages are buffered in case the session is resumed
+	overflowed     bool          // messages were dropped while detached, or the client was too slow
+	dropReason     string        // the websocket is closed with this reason once the outbox is written
 }
 
 // NewWSConn creates a new wsConn handler
-func newWSConn(conn *websocket.Conn) *wsConn {
-	ws := &wsConn{sync.Mutex{}, conn, nil, "error: uninitialized", false}
+func newWSConn(conn *websocket.Conn, codec codec, receiveEvents bool) *wsConn {
+	ws := &wsConn{
+		conn:          conn,
+		codec:         codec,
+		Name:          "error: uninitialized",
+		receiveEvents: receiveEvents,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	go ws.writeLoop()
 	return ws
 }
 
+// keepAlive pings the client every interval until the connection is closed
+// each pong extends the read deadline by pongWait: reads fail when a client stops answering,
+// or if pings can't be sent, which drops the connection
+// it must be called before reading from the connection
+func (ws *wsConn) keepAlive(interval time.Duration, pongWait time.Duration) {
+	conn := ws.conn
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ws.done:
+				return
+			case <-ticker.C:
+				// WriteControl can be called concurrently with other writes
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					log.Debug(ws.Name, ": can't ping, closing: ", err.Error())
+					conn.Close() // the read loop will fail and clean up
+					return
+				}
+			}
+		}
+	}()
+}
+
 // writeJSON sends a new object in the array, to be sent later
+// changes about the same agent or POI are coalesced until then
+// while the connection is detached, objects are kept until it's attached again, up to MaxResumeBuffer
 func (ws *wsConn) writeJSON(msg JSONChangeMessage) {
+	ws.Lock()
+	defer ws.Unlock()
+
 	if ws.closing {
 		return
 	}
+	if ws.detached {
+		if ws.coalesce(msg) {
+			return
+		}
+		if len(ws.buffer)-ws.removed >= MaxResumeBuffer {
+			ws.overflowed = true
+			return
+		}
+		ws.bufferChange(msg)
+		return
+	}
 
-	ws.Lock()
-	defer ws.Unlock()
-
-	// if nothing was buffered yet, schedule a flush for later
-	if ws.buffer == nil {
-		time.AfterFunc(MessageSendInterval, func() {
-			ws.Flush()
-		})
+	if ws.queued() >= MaxQueuedMessages {
+		if OverflowPolicy == OverflowCoalesce && ws.coalesce(msg) {
+			overflowCoalesced.Add(1)
+			return
+		}
+		ws.overflow(msg)
+		return
+	}
+	if ws.coalesce(msg) {
+		return
 	}
 
 	// add to buffer
-	ws.buffer = append(ws.buffer, msg)
+	ws.bufferChange(msg)
+	ws.scheduleFlush()
 }
 
 // writeImmediateJSON sends a new object immediately (no buffering)
+// it's dropped if the connection is detached
 func (ws *wsConn) writeImmediateJSON(msg interface{}) {
-	// log.Debug("WS enter writeImmediateJSON")
-	// defer log.Debug("WS done writeImmediateJSON")
-	if ws.closing {
+	ws.Lock()
+	defer ws.Unlock()
+
+	if ws.closing || ws.detached {
+		return
+	}
+	if ws.queued() >= MaxQueuedMessages {
+		ws.overflow(msg)
 		return
 	}
+	ws.enqueue(msg, 1)
+}
+
+// queued returns the number of messages waiting to be written, it must be called with the lock held
+func (ws *wsConn) queued() int {
+	return len(ws.buffer) - ws.removed + ws.outboxLen
+}
+
+// enqueue hands msg over to the writer, it must be called with the lock held
+func (ws *wsConn) enqueue(msg interface{}, count int) {
+	ws.outbox = append(ws.outbox, msg)
+	ws.outboxLen += count
+	select {
+	case ws.wake <- struct{}{}:
+	default: // the writer is already awake
+	}
+}
+
+// scheduleFlush flushes the buffer after MessageSendInterval, it must be called with the lock held
+func (ws *wsConn) scheduleFlush() {
+	if ws.flushScheduled {
+		return
+	}
+	ws.flushScheduled = true
+	time.AfterFunc(MessageSendInterval, func() {
+		ws.Flush()
+	})
+}
+
+// overflow applies OverflowPolicy to msg when the queue is full, it must be called with the lock held
+func (ws *wsConn) overflow(msg interface{}) {
+	if OverflowPolicy == OverflowDrop {
+		overflowDropped.Add(1)
+		return
+	}
+	ws.disconnect()
+}
+
+// disconnect drops a client which doesn't read its messages fast enough, it must be called with the lock held
+// the session can't be resumed
+func (ws *wsConn) disconnect() {
+	if ws.overflowed {
+		return
+	}
+	ws.overflowed = true
+	overflowDisconnections.Add(1)
+	log.Warn(ws.Name, ": too many queued messages, disconnecting")
+
+	ws.buffer = nil
+	ws.lastChanges = nil
+	ws.removed = 0
+	ws.outbox = nil
+	ws.outboxLen = 0
+	conn := ws.conn
+	go closeWithReason(conn, ErrSlowConsumer.Code) // the read loop will fail and clean up
+}
+
+// dropWithError sends err, then closes the websocket with its code in the close message
+// the writer closes it once the queued messages are written
+func (ws *wsConn) dropWithError(err *GeeoError) {
 	ws.Lock()
 	defer ws.Unlock()
+	if ws.closing || ws.detached {
+		return // the websocket is closed already
+	}
+	ws.dropReason = err.Code
+	ws.enqueue(err.toJSON(), 1) // even if the outbox is full
+}
+
+// closeIfDropped closes the websocket once the outbox is written, if dropWithError was called
+func (ws *wsConn) closeIfDropped() {
+	ws.Lock()
+	if ws.dropReason == "" || ws.detached || len(ws.outbox) > 0 {
+		ws.Unlock()
+		return
+	}
+	conn, reason := ws.conn, ws.dropReason
+	ws.dropReason = ""
+	ws.Unlock()
+	closeWithReason(conn, reason) // the read loop will fail and clean up
+}
+
+// drop closes the websocket, with reason in the close message
+func (ws *wsConn) drop(reason string) {
+	ws.Lock()
+	conn := ws.conn
+	ws.Unlock()
+	closeWithReason(conn, reason)
+}
 
-	err := ws.conn.WriteJSON(msg)
-	if err != nil {
-		log.Errorf("%s: error %s", ws.Name, err.Error())
+func closeWithReason(conn *websocket.Conn, reason string) {
+	// WriteControl can be called concurrently with other writes
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(WriteWait))
+	conn.Close()
+}
+
+// writeLoop writes queued messages until the connection is closed
+// it's the only goroutine writing messages, pings and close messages excepted
+func (ws *wsConn) writeLoop() {
+	for {
+		select {
+		case <-ws.wake:
+			ws.writeQueued()
+			ws.closeIfDropped()
+		case <-ws.done:
+			ws.writeQueued() // errors sent before closing
+			ws.Lock()
+			conn, reason := ws.conn, ws.dropReason
+			ws.Unlock()
+			if reason != "" {
+				closeWithReason(conn, reason)
+			} else {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// writeQueued writes the outbox, each message with a deadline of WriteWait
+// if a write fails, the connection is detached and the objects are kept, in case it's resumed
+func (ws *wsConn) writeQueued() {
+	ws.Lock()
+	if ws.detached || len(ws.outbox) == 0 {
+		ws.Unlock()
+		return
+	}
+	conn, codec, msgs := ws.conn, ws.codec, ws.outbox
+	ws.outbox = nil
+	ws.outboxLen = 0
+	ws.Unlock()
+
+	for i, msg := range msgs {
+		data, err := codec.marshal(msg)
+		if err != nil {
+			log.Errorf("%s: error %s", ws.Name, err.Error())
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(WriteWait))
+		if err := conn.WriteMessage(codec.messageType(), data); err != nil {
+			log.Errorf("%s: error %s", ws.Name, err.Error())
+			ws.Lock()
+			if ws.conn == conn {
+				ws.detached = true
+				conn.Close()
+			}
+			ws.requeue(msgs[i:])
+			ws.Unlock()
+			return
+		}
+	}
+}
+
+// requeue puts the arrays of msgs back in the buffer, it must be called with the lock held
+// single messages are dropped
+func (ws *wsConn) requeue(msgs []interface{}) {
+	if ws.closing || ws.overflowed {
+		return
+	}
+	var buffer []JSONChangeMessage
+	for _, msg := range msgs {
+		if changes, ok := msg.([]JSONChangeMessage); ok {
+			buffer = append(buffer, changes...)
+		}
+	}
+	if len(buffer) == 0 {
+		return
+	}
+	ws.compact()
+	ws.buffer = append(buffer, ws.buffer...)
+	if !ws.detached {
+		ws.scheduleFlush()
 	}
 }
 
 func (ws *wsConn) close() {
 	log.Debug("WS closing ", ws.Name)
+	ws.Lock()
+	defer ws.Unlock()
+	if ws.closing {
+		return
+	}
 	ws.closing = true
+	close(ws.done) // the writer closes the websocket
 	ws.buffer = nil
-	ws.conn = nil
 }
 
+// detach closes the websocket, but keeps buffering messages until attach or close is called
+func (ws *wsConn) detach() {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.detached = true
+	ws.conn.Close()
+	msgs := ws.outbox
+	ws.outbox = nil
+	ws.outboxLen = 0
+	ws.requeue(msgs)
+}
+
+// attach replaces the websocket, closing the previous one if it wasn't detached yet
+// Flush must be called to send the messages buffered while detached
+func (ws *wsConn) attach(conn *websocket.Conn, codec codec, receiveEvents bool) {
+	ws.Lock()
+	defer ws.Unlock()
+	if !ws.detached {
+		ws.conn.Close()
+	}
+	ws.conn = conn
+	ws.codec = codec
+	ws.receiveEvents = receiveEvents
+	ws.detached = false
+	ws.dropReason = ""
+}
+
+// isAttachedTo returns true if conn is still the websocket of the connection, even if it's detached
+// it's false once another websocket took over
+func (ws *wsConn) isAttachedTo(conn *websocket.Conn) bool {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.conn == conn
+}
+
+func (ws *wsConn) setReceiveEvents(receiveEvents bool) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.receiveEvents = receiveEvents
+}
+
+func (ws *wsConn) receivesEvents() bool {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.receiveEvents
+}
+
+// hasOverflowed returns true if messages were dropped while detached, or if the client was too slow
+func (ws *wsConn) hasOverflowed() bool {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.overflowed
+}
+
+// Flush hands the buffered objects over to the writer, as an array
 func (ws *wsConn) Flush() {
-	log.Debug("WS flush ", ws.Name, ", len=", len(ws.buffer))
 	ws.Lock()
-	if ws.buffer != nil {
-		ws.Unlock()
-		ws.writeImmediateJSON(ws.buffer)
-		ws.buffer = nil
-	} else {
-		ws.Unlock()
+	defer ws.Unlock()
+	log.Debug("WS flush ", ws.Name, ", len=", len(ws.buffer))
+	ws.flushScheduled = false
+	if ws.detached || ws.closing {
+		return
 	}
+	ws.compact()
+	if len(ws.buffer) == 0 {
+		return
+	}
+	buffer := ws.buffer
+	ws.buffer = nil
+	ws.enqueue(buffer, len(buffer))
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// JSONSession is sent when a session starts or is resumed, if sessions can be resumed
+type JSONSession struct {
+	ResumeToken string  `json:"resumeToken"`
+	Grace       float64 `json:"grace"` // in seconds
+	Resumed     bool    `json:"resumed,omitempty"`
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Can't generate resume token: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sessionMessage is sent to clients to let them resume their session
+func (s *wsSession) sessionMessage(resumed bool) interface{} {
+	return struct {
+		Session *JSONSession `json:"session"`
+	}{&JSONSession{ResumeToken: s.resumeToken, Grace: ResumeGracePeriod.Seconds(), Resumed: resumed}}
+}
+
+// closeSuspendedSessions closes the suspended sessions with the token's agent and view
+// the client didn't resume them, they must be closed before a new session adds the same agent and view
+func (wsh *WSRouter) closeSuspendedSessions(token *JWTToken) {
+	var previous []*wsSession
+	wsh.sessionsLock.Lock()
+	for resumeToken, each := range wsh.sessions {
+		if each.suspended && each.token.AgentID == token.AgentID && each.token.ViewID == token.ViewID {
+			delete(wsh.sessions, resumeToken)
+			previous = append(previous, each)
+		}
+	}
+	wsh.sessionsLock.Unlock()
+
+	for _, each := range previous {
+		each.close()
+	}
+}
+
+// registerSession keeps track of a new session, so that it can be resumed or revoked
+func (wsh *WSRouter) registerSession(s *wsSession) {
+	s.resumeToken = newResumeToken()
+
+	wsh.sessionsLock.Lock()
+	wsh.sessions[s.resumeToken] = s
+	wsh.sessionsLock.Unlock()
+}
+
+// resumeSession attaches conn to the session of resumeToken, suspended or not
+// the session must accept the token, whose capabilities replace the previous ones
+func (wsh *WSRouter) resumeSession(resumeToken string, token *JWTToken, conn *websocket.Conn, codec codec) (*wsSession, error) {
+	wsh.sessionsLock.Lock()
+	s, ok := wsh.sessions[resumeToken]
+	wsh.sessionsLock.Unlock()
+	if !ok {
+		return nil, ErrResumeFailed
+	}
+
+	// the read loop of a live session finishes its command first, then fails to read
+	s.commands.Lock()
+	defer s.commands.Unlock()
+
+	wsh.sessionsLock.Lock()
+	if wsh.sessions[resumeToken] != s {
+		wsh.sessionsLock.Unlock()
+		return nil, ErrResumeFailed // closed meanwhile
+	}
+	if err := s.accepts(token); err != nil {
+		wsh.sessionsLock.Unlock()
+		gerr := asGeeoError(err)
+		if gerr.Detail != "" {
+			return nil, ErrResumeFailed.withDetail(gerr.Detail)
+		}
+		return nil, ErrResumeFailed.withDetail(gerr.Message)
+	}
+	if s.ws.hasOverflowed() {
+		// the client missed too many messages
+		delete(wsh.sessions, resumeToken)
+		wsh.sessionsLock.Unlock()
+		s.close()
+		return nil, ErrResumeFailed
+	}
+	s.suspended = false
+	s.token = token
+	s.limiter.setLimits(token.Capabilities.RateLimits)
+	wsh.sessionsLock.Unlock()
+
+	s.ws.attach(conn, codec, token.Capabilities.ReceiveEvents)
+	s.scheduleExpiry(token)
+	return s, nil
+}
+
+// endConnection is called when the websocket of a session is lost
+// the session is closed if the client left, was too slow or was revoked, otherwise it's suspended for ResumeGracePeriod
+func (wsh *WSRouter) endConnection(s *wsSession, conn *websocket.Conn, left bool) {
+	if !s.ws.isAttachedTo(conn) {
+		return // the session was resumed on another websocket
+	}
+	wsh.sessionsLock.Lock()
+	if ResumeGracePeriod == 0 || left || s.revoked || s.ws.hasOverflowed() {
+		delete(wsh.sessions, s.resumeToken)
+		wsh.sessionsLock.Unlock()
+		s.close()
+		return
+	}
+	defer wsh.sessionsLock.Unlock()
+	s.ws.detach()
+	s.suspended = true
+	s.suspensions++
+	suspension := s.suspensions
+	time.AfterFunc(ResumeGracePeriod, func() {
+		wsh.sessionsLock.Lock()
+		if !s.suspended || s.suspensions != suspension || wsh.sessions[s.resumeToken] != s {
+			wsh.sessionsLock.Unlock()
+			return // resumed or already closed
+		}
+		delete(wsh.sessions, s.resumeToken)
+		wsh.sessionsLock.Unlock()
+		log.Debug("session expired: ", s.identity)
+		s.close()
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"geeo.io/GeeoServer/quad"
+)
+
+// wsSession holds the state of a websocket connection: its token, its agent and its views
+type wsSession struct {
+	wsh      *WSRouter
+	ws       *wsConn
+	token    *JWTToken
+	identity string
+
+	agent   *Agent
+	views   map[string]*View // by view id, as named by the client
+	limiter *rateLimiter
+
+	// held while a command is handled, or while the session is resumed
+	// the websocket of a live session can be replaced, while its read loop still handles a command
+	commands sync.Mutex
+
+	// resumable sessions survive their websocket for ResumeGracePeriod
+	resumeToken string
+	suspended   bool
+	suspensions int  // counts suspensions, to ignore the expiry of previous ones
+	revoked     bool // the session is closed when its websocket is lost
+
+	// sessions are warned, then disconnected, when their token expires
+	expiryLock    sync.Mutex
+	expiringToken *JWTToken
+	expiryWarning *time.Timer
+	expiry        *time.Timer
+}
+
+// newWSSession creates the agent and the default view allowed by the token
+// it fails if another session uses them, ws must then be closed
+func newWSSession(wsh *WSRouter, ws *wsConn, token *JWTToken) (*wsSession, error) {
+	s := &wsSession{wsh: wsh, ws: ws, token: token, views: make(map[string]*View)}
+	s.limiter = wsh.acquireLimiter(token)
+
+	capabilities := token.Capabilities
+	if capabilities.Produce {
+		agent, err := wsh.db.addAgent(token.AgentID, ws, token.Public)
+		if err != nil {
+			wsh.releaseLimiter(token)
+			return nil, err
+		}
+		s.agent = agent
+		s.identity = "agent:" + token.AgentID
+	}
+	if capabilities.Consume {
+		view, err := wsh.db.addView(s.viewKey(token.ViewID), token.ViewID, ws)
+		if err != nil {
+			if s.agent != nil {
+				wsh.db.removeAgent(*s.agent.ID)
+			}
+			wsh.releaseLimiter(token)
+			return nil, err
+		}
+		s.views[token.ViewID] = view
+		s.identity = "view:" + token.ViewID
+	}
+	if capabilities.Produce && capabilities.Consume {
+		s.identity = "agent:" + token.AgentID + "+view:" + token.ViewID
+	}
+	ws.Name = s.identity
+	s.scheduleExpiry(token)
+
+	return s, nil
+}
+
+// viewKey returns the id of a view in GeeoDB
+// the default view uses the token's viewId, the others are prefixed by it
+// both are escaped, so that only the separator is a "/" and keys of different views never collide
+func (s *wsSession) viewKey(name string) string {
+	if name == s.token.ViewID {
+		return url.PathEscape(name)
+	}
+	return url.PathEscape(s.token.ViewID) + "/" + url.PathEscape(name)
+}
+
+func (s *wsSession) addView(name string, pos *quad.Rect, filter *ViewFilter) error {
+	if _, exists := s.views[name]; exists {
+		return ErrViewExists
+	}
+	if len(s.views) >= s.token.Capabilities.MaxViews {
+		return ErrTooManyViews
+	}
+	if err := s.token.Capabilities.checkViewSize(pos); err != nil {
+		return err
+	}
+	if err := s.token.Capabilities.checkRect(pos); err != nil {
+		return err
+	}
+	view, err := s.wsh.db.addView(s.viewKey(name), name, s.ws)
+	if err != nil {
+		return err
+	}
+	view.filter = filter
+	s.views[name] = view
+	s.wsh.handleViewMove(view, pos)
+	return nil
+}
+
+// moveView changes the filter of a view if filter isn't nil, then moves it if pos isn't nil
+func (s *wsSession) moveView(name string, pos *quad.Rect, filter *ViewFilter) error {
+	view, exists := s.views[name]
+	if !exists {
+		return ErrViewNotFound
+	}
+	if pos != nil {
+		if err := s.token.Capabilities.checkViewSize(pos); err != nil {
+			return err
+		}
+		if err := s.token.Capabilities.checkRect(pos); err != nil {
+			return err
+		}
+	}
+	if filter != nil {
+		s.wsh.handleViewFilter(view, filter)
+	}
+	if pos != nil {
+		s.wsh.handleViewMove(view, pos)
+	}
+	return nil
+}
+
+func (s *wsSession) removeView(name string) error {
+	view, exists := s.views[name]
+	if !exists {
+		return ErrViewNotFound
+	}
+	s.wsh.db.removeView(view)
+	delete(s.views, name)
+	return nil
+}
+
+// writeError sends an error for a part of a command, with the command's reqId if it has one
+func (s *wsSession) writeError(command *JSONCommand, name string, err error) {
+	gerr := asGeeoError(err)
+	reply := gerr.toJSON()
+	reply.ReqID = command.ReqID
+	reply.Command = name
+	s.ws.writeImmediateJSON(reply)
+	log.Warn(s.identity, ": ", name, " ", gerr.Message, " ", gerr.Detail)
+}
+
+// reply acknowledges a part of a command: errors are always sent, successes only when the command has a reqId
+func (s *wsSession) reply(command *JSONCommand, name string, err error) {
+	if err != nil {
+		s.writeError(command, name, err)
+		return
+	}
+	if command.ReqID != nil {
+		s.ws.writeImmediateJSON(&JSONReply{ReqID: command.ReqID, Command: name, OK: true})
+	}
+}
+
+// allow returns err if the capability isn't allowed, or ErrRateLimited if the command exceeds its rate limit
+func (s *wsSession) allow(name string, allowed bool, err error) error {
+	if !allowed {
+		return err
+	}
+	if !s.limiter.allow(name, time.Now()) {
+		rateLimited.Add(name, 1)
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// handleCommand runs each part of a command allowed by the token's capabilities
+// each part is acknowledged when the command has a reqId
+func (s *wsSession) handleCommand(command *JSONCommand) {
+	s.commands.Lock()
+	defer s.commands.Unlock()
+
+	wsh := s.wsh
+	agent := s.agent
+
+	// the rest of the command uses the capabilities of the refreshed token
+	if command.RefreshToken != nil {
+		err := s.allow("refreshToken", true, nil)
+		if err == nil {
+			err = s.refreshToken(*command.RefreshToken)
+		}
+		s.reply(command, "refreshToken", err)
+	}
+
+	capabilities := s.token.Capabilities
+
+	if command.AgentPosition != nil {
+		err := s.allow("agentPosition", capabilities.Produce, ErrCantProduce)
+		if err == nil {
+			err = capabilities.checkPoint(command.AgentPosition)
+		}
+		if err == nil {
+			wsh.handleAgentMove(agent, command.AgentPosition)
+		}
+		s.reply(command, "agentPosition", err)
+	}
+
+	if command.ViewPosition != nil || command.ViewFilter != nil {
+		// viewPosition and viewFilter change the default view
+		err := s.allow("viewPosition", capabilities.Consume, ErrCantConsume)
+		if err == nil {
+			err = s.moveView(s.token.ViewID, command.ViewPosition, command.ViewFilter)
+		}
+		s.reply(command, "viewPosition", err)
+	}
+
+	if command.AddView != nil {
+		err := s.allow("addView", capabilities.Consume, ErrCantConsume)
+		if err == nil {
+			err = s.addView(*command.AddView.ID, command.AddView.Pos, command.AddView.Filter)
+		}
+		s.reply(command, "addView", err)
+	}
+
+	if command.MoveView != nil {
+		err := s.allow("moveView", capabilities.Consume, ErrCantConsume)
+		if err == nil {
+			err = s.moveView(*command.MoveView.ID, command.MoveView.Pos, command.MoveView.Filter)
+		}
+		s.reply(command, "moveView", err)
+	}
+
+	if command.RemoveView != nil {
+		err := s.allow("removeView", capabilities.Consume, ErrCantConsume)
+		if err == nil {
+			err = s.removeView(*command.RemoveView.ID)
+		}
+		s.reply(command, "removeView", err)
+	}
+
+	if command.AgentPublicData != nil {
+		err := s.allow("publicData", capabilities.Produce, ErrCantProduce)
+		if err == nil {
+			wsh.handleAgentPublicData(agent, command.AgentPublicData)
+		}
+		s.reply(command, "publicData", err)
+	}
+
+	var creator *string
+	if agent != nil {
+		creator = agent.ID
+	}
+
+	if command.CreatePOI != nil {
+		err := s.allow("createPOI", capabilities.POI, ErrCantUpdatePOI)
+		poi := command.CreatePOI
+		if err == nil {
+			err = capabilities.checkPoint(poi.Pos)
+		}
+		if err == nil {
+			err = wsh.handlePOICreate(poi.ID, poi.Pos, poi.PublicData, creator, poi.acl(creator), poi.expiry())
+		}
+		s.reply(command, "createPOI", err)
+	}
+
+	if command.UpdatePOI != nil {
+		err := s.allow("updatePOI", capabilities.POI, ErrCantUpdatePOI)
+		if err == nil {
+			update := command.UpdatePOI
+			_, err = wsh.handlePOIUpdate(update.ID, update.Pos, update.PublicData, update.ACL, update.expiry(), s.token)
+		}
+		s.reply(command, "updatePOI", err)
+	}
+
+	if command.RemovePOI != nil {
+		err := s.allow("removePOI", capabilities.POI, ErrCantUpdatePOI)
+		if err == nil {
+			err = wsh.handlePOIRemove(command.RemovePOI.ID, s.token)
+		}
+		s.reply(command, "removePOI", err)
+	}
+
+	if command.CreateAirBeacon != nil {
+		err := s.allow("createAirBeacon", capabilities.AirBeacon, ErrCantUpdateAirBeacon)
+		ab := command.CreateAirBeacon
+		if err == nil {
+			err = capabilities.checkAirBeaconSize(ab)
+		}
+		if err == nil {
+			err = capabilities.checkRect(ab.Pos)
+		}
+		if err == nil {
+			err = wsh.handleAirBeaconCreate(ab.ID, ab.Pos, ab.shape(), ab.PublicData, creator, ab.acl(creator))
+		}
+		s.reply(command, "createAirBeacon", err)
+	}
+
+	if command.RemoveAirBeacon != nil {
+		err := s.allow("removeAirBeacon", capabilities.AirBeacon, ErrCantUpdateAirBeacon)
+		if err == nil {
+			err = wsh.handleAirBeaconRemove(command.RemoveAirBeacon.ID, s.token)
+		}
+		s.reply(command, "removeAirBeacon", err)
+	}
+
+	if command.SendEvent != nil {
+		err := s.allow("sendEvent", capabilities.SendEvents, ErrCantSendEvents)
+		event := command.SendEvent
+		if err == nil {
+			err = capabilities.checkRadius(event.Radius)
+		}
+		if err == nil {
+			err = capabilities.checkCircle(event.Pos, event.Radius)
+		}
+		if err == nil {
+			event.From = creator
+			wsh.handleEvent(event)
+		}
+		s.reply(command, "sendEvent", err)
+	}
+
+	if command.SendMessage != nil {
+		err := s.allow("sendMessage", capabilities.SendMessages && agent != nil, ErrCantSendMessages)
+		if err == nil {
+			err = wsh.handleSendMessage(agent, command.SendMessage)
+		}
+		s.reply(command, "sendMessage", err)
+	}
+
+	if command.Nearest != nil {
+		err := s.allow("nearest", capabilities.Consume, ErrCantConsume)
+		if err == nil {
+			err = capabilities.checkPoint(command.Nearest.Pos)
+		}
+		if err == nil {
+			wsh.handleNearest(s.ws, command.Nearest, agent, &capabilities)
+		}
+		s.reply(command, "nearest", err)
+	}
+}
+
+// close removes the agent and the views of the session
+func (s *wsSession) close() {
+	if s.agent != nil {
+		s.wsh.db.removeAgent(*s.agent.ID)
+		s.wsh.handleAgentLeft(s.agent)
+	}
+	for _, view := range s.views {
+		s.wsh.db.removeView(view)
+	}
+	s.cancelExpiry()
+	s.wsh.releaseLimiter(s.token)
+	s.ws.close()
+}
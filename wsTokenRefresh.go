@@ -0,0 +1,128 @@
+package main
+
+import "time"
+
+// JSONTokenExpiring warns a client that its token expires soon, it should send a refreshToken command
+type JSONTokenExpiring struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// scheduleExpiry warns the client TokenExpiryWarning before its token expires, and disconnects it when it expires
+// the timers of the previous token are stopped
+func (s *wsSession) scheduleExpiry(token *JWTToken) {
+	s.expiryLock.Lock()
+	defer s.expiryLock.Unlock()
+
+	s.stopExpiryTimers()
+	s.expiringToken = token
+	if token.ExpiresAt == 0 {
+		return
+	}
+
+	expiresAt := time.Unix(token.ExpiresAt, 0)
+	untilExpiry := time.Until(expiresAt)
+	if TokenExpiryWarning > 0 && untilExpiry > TokenExpiryWarning {
+		s.expiryWarning = time.AfterFunc(untilExpiry-TokenExpiryWarning, func() {
+			if s.isExpiring(token) {
+				s.ws.writeImmediateJSON(struct {
+					TokenExpiring *JSONTokenExpiring `json:"tokenExpiring"`
+				}{&JSONTokenExpiring{ExpiresAt: expiresAt}})
+			}
+		})
+	}
+	s.expiry = time.AfterFunc(untilExpiry, func() {
+		if !s.isExpiring(token) {
+			return // refreshed meanwhile
+		}
+		log.Info(s.identity, ": token expired, disconnecting")
+		s.ws.dropWithError(ErrTokenExpired)
+	})
+}
+
+// isExpiring returns true if token is still the one whose expiry is scheduled
+func (s *wsSession) isExpiring(token *JWTToken) bool {
+	s.expiryLock.Lock()
+	defer s.expiryLock.Unlock()
+	return s.expiringToken == token
+}
+
+// cancelExpiry stops the timers of the token
+func (s *wsSession) cancelExpiry() {
+	s.expiryLock.Lock()
+	defer s.expiryLock.Unlock()
+	s.stopExpiryTimers()
+	s.expiringToken = nil
+}
+
+// stopExpiryTimers must be called with expiryLock held
+func (s *wsSession) stopExpiryTimers() {
+	if s.expiryWarning != nil {
+		s.expiryWarning.Stop()
+		s.expiryWarning = nil
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+}
+
+// accepts returns an error if token can't replace the token of the session, when it's refreshed or resumed
+// it must be for the same agent and view, with the same produce and consume capabilities
+func (s *wsSession) accepts(token *JWTToken) error {
+	if token.AgentID != s.token.AgentID || token.ViewID != s.token.ViewID {
+		return ErrInvalidJWTToken.withDetail("the token must have the same agentId and viewId")
+	}
+	if token.Capabilities.Produce != s.token.Capabilities.Produce || token.Capabilities.Consume != s.token.Capabilities.Consume {
+		return ErrInvalidCapabilities.withDetail("produce and consume can't change")
+	}
+	return s.fits(&token.Capabilities)
+}
+
+// fits returns an error if the agent or the views of the session aren't allowed by capabilities
+// commands must be locked, or the session suspended
+func (s *wsSession) fits(capabilities *JWTTokenCaps) error {
+	if len(s.views) > capabilities.MaxViews {
+		return ErrTooManyViews.withDetail("the session has more views than the token allows")
+	}
+	if s.agent != nil {
+		if pos := s.agent.GetPoint(); pos != nil {
+			if err := capabilities.checkPoint(pos); err != nil {
+				return err
+			}
+		}
+	}
+	for _, view := range s.views {
+		if pos := view.GetRect(); pos != nil {
+			if err := capabilities.checkViewSize(pos); err != nil {
+				return err
+			}
+			if err := capabilities.checkRect(pos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refreshToken replaces the token of the session with a fresh one, for the same agent and view
+// the agent and views are kept: produce and consume can't change, the other capabilities are replaced
+func (s *wsSession) refreshToken(b64tok string) error {
+	token, err := parseJWTToken(b64tok)
+	if err != nil {
+		return tokenError(err)
+	}
+	if err := s.accepts(token); err != nil {
+		return err
+	}
+
+	// the token of a session is also read when sessions are resumed
+	s.wsh.sessionsLock.Lock()
+	s.token = token
+	s.wsh.sessionsLock.Unlock()
+
+	s.limiter.setLimits(token.Capabilities.RateLimits)
+	s.ws.setReceiveEvents(token.Capabilities.ReceiveEvents)
+	s.scheduleExpiry(token)
+	log.Debug(s.identity, ": token refreshed")
+	return nil
+}